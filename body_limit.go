@@ -0,0 +1,85 @@
+package falcore
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Returned when reading a request body past the Pipeline's MaxBodyBytes.
+// The server answers such requests with a 413 regardless of what the
+// pipeline returned.
+var ErrBodyTooLarge = errors.New("falcore: request body too large")
+
+// Fallback for filters that buffer whole bodies when no MaxBodyBytes
+// has been set.
+const DefaultMaxBodyBytes = int64(10 << 20)
+
+// Counts body bytes against the request's limit
+type maxBodyReader struct {
+	req   *Request
+	r     io.ReadCloser
+	read  int64
+	limit int64
+}
+
+var _ io.ReadCloser = new(maxBodyReader)
+
+func (r *maxBodyReader) Read(p []byte) (int, error) {
+	if r.read >= r.limit {
+		// see if there's anything beyond the limit
+		var b [1]byte
+		if n, err := r.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		r.req.bodyTooLarge = true
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > r.limit-r.read {
+		p = p[:r.limit-r.read]
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *maxBodyReader) Close() error {
+	return r.r.Close()
+}
+
+// Applies a body size limit to the request.  The effective limit is the
+// smallest one applied.  Returns a 413 response if the declared
+// Content-Length is already too large.
+func (fReq *Request) limitBody(limit int64) *http.Response {
+	if limit <= 0 || (fReq.maxBodyBytes > 0 && limit >= fReq.maxBodyBytes) {
+		return nil
+	}
+	fReq.maxBodyBytes = limit
+	req := fReq.HttpRequest
+	if req.ContentLength > limit {
+		fReq.bodyTooLarge = true
+		return bodyTooLargeResponse(req)
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if mbr, ok := req.Body.(*maxBodyReader); ok {
+		mbr.limit = limit
+	} else {
+		req.Body = &maxBodyReader{req: fReq, r: req.Body, limit: limit}
+	}
+	return nil
+}
+
+func bodyTooLargeResponse(req *http.Request) *http.Response {
+	res := StringResponse(req, 413, nil, "Request Entity Too Large\n")
+	// the rest of the body is still on the connection
+	res.Close = true
+	return res
+}
+
+// The effective body size limit for this request, set by
+// Pipeline.MaxBodyBytes.  Zero means no limit.
+func (fReq *Request) MaxBodyBytes() int64 {
+	return fReq.maxBodyBytes
+}
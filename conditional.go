@@ -0,0 +1,195 @@
+package falcore
+
+import (
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Decides whether a conditional filter runs.  res is the response for
+// ResponseFilters wrapped by WhenResponse and nil for RequestFilters.
+type Predicate func(req *Request, res *http.Response) bool
+
+// Runs filter only for requests pred accepts.  In a Pipeline, a
+// skipped filter still gets a stage in PipelineStageStats, under the
+// filter's own name with Status 1 (skip), so the Signature tells the
+// paths apart.  A panic in pred is handled like one in the filter and
+// fails its stage.
+//
+//	pipeline.Upstream.PushBack(falcore.When(falcore.PathPrefix("/admin/"), auth))
+func When(pred Predicate, filter RequestFilter) RequestFilter {
+	return &conditionalFilter{pred, filter}
+}
+
+// Runs filter only for requests pred rejects
+func Unless(pred Predicate, filter RequestFilter) RequestFilter {
+	return When(Not(pred), filter)
+}
+
+// Runs filter only for responses pred accepts.  Skips are recorded like
+// When's.
+func WhenResponse(pred Predicate, filter ResponseFilter) ResponseFilter {
+	return &conditionalResponseFilter{pred, filter}
+}
+
+// Runs filter only for responses pred rejects
+func UnlessResponse(pred Predicate, filter ResponseFilter) ResponseFilter {
+	return WhenResponse(Not(pred), filter)
+}
+
+type conditionalFilter struct {
+	pred   Predicate
+	filter RequestFilter
+}
+
+// Outside a Pipeline, the wrapper does its own checking
+func (f *conditionalFilter) FilterRequest(req *Request) *http.Response {
+	if !f.pred(req, nil) {
+		req.CurrentStage.Status = 1
+		return nil
+	}
+	return f.filter.FilterRequest(req)
+}
+
+type conditionalResponseFilter struct {
+	pred   Predicate
+	filter ResponseFilter
+}
+
+func (f *conditionalResponseFilter) FilterResponse(req *Request, res *http.Response) {
+	if !f.pred(req, res) {
+		req.CurrentStage.Status = 1
+		return
+	}
+	f.filter.FilterResponse(req, res)
+}
+
+// Runs pred for a conditional filter in a Pipeline.  When filter won't
+// run, a stage is recorded for it: skipped if pred rejected the request,
+// failed if pred panicked, along with the response to send instead.
+func (p *Pipeline) checkCondition(req *Request, pred Predicate, res *http.Response, filter interface{}, stageType PipelineStageType) (run bool, failed *http.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			startFilterStage(req, filter, stageType)
+			failed = p.recovered(req, err)
+			req.finishPipelineStage()
+		}
+	}()
+	if pred(req, res) {
+		return true, nil
+	}
+	startFilterStage(req, filter, stageType)
+	req.CurrentStage.Status = 1
+	req.finishPipelineStage()
+	return false, nil
+}
+
+func startFilterStage(req *Request, filter interface{}, stageType PipelineStageType) {
+	// named after the filter inside any further conditions
+	for {
+		if c, ok := filter.(*conditionalFilter); ok {
+			filter = c.filter
+		} else if c, ok := filter.(*conditionalResponseFilter); ok {
+			filter = c.filter
+		} else {
+			break
+		}
+	}
+	req.startPipelineStage(reflect.TypeOf(filter).String())
+	req.CurrentStage.Type = stageType
+}
+
+// Accepts everything pred rejects
+func Not(pred Predicate) Predicate {
+	return func(req *Request, res *http.Response) bool {
+		return !pred(req, res)
+	}
+}
+
+// Accepts what all of preds accept
+func And(preds ...Predicate) Predicate {
+	return func(req *Request, res *http.Response) bool {
+		for _, pred := range preds {
+			if !pred(req, res) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Accepts what any of preds accepts
+func Or(preds ...Predicate) Predicate {
+	return func(req *Request, res *http.Response) bool {
+		for _, pred := range preds {
+			if pred(req, res) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Accepts requests whose path starts with prefix
+func PathPrefix(prefix string) Predicate {
+	return func(req *Request, res *http.Response) bool {
+		return strings.HasPrefix(req.HttpRequest.URL.Path, prefix)
+	}
+}
+
+// Accepts requests with one of methods
+func Method(methods ...string) Predicate {
+	return func(req *Request, res *http.Response) bool {
+		for _, m := range methods {
+			if req.HttpRequest.Method == m {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Accepts requests that have the header name.  If values are given,
+// the header must have one of them.
+func Header(name string, values ...string) Predicate {
+	name = http.CanonicalHeaderKey(name)
+	return func(req *Request, res *http.Response) bool {
+		have := req.HttpRequest.Header[name]
+		if len(values) == 0 {
+			return len(have) > 0
+		}
+		for _, h := range have {
+			for _, v := range values {
+				if h == v {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// Accepts a Content-Type matching one of types, which may end in a
+// wildcard like "text/*".  Parameters like charset are ignored.  For
+// ResponseFilters the response's Content-Type is checked, otherwise
+// the request's.
+func ContentType(types ...string) Predicate {
+	return func(req *Request, res *http.Response) bool {
+		header := req.HttpRequest.Header
+		if res != nil {
+			header = res.Header
+		}
+		ct, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil {
+			return false
+		}
+		for _, t := range types {
+			t = strings.ToLower(t)
+			if ct == t || (strings.HasSuffix(t, "/*") && strings.HasPrefix(ct, t[:len(t)-1])) {
+				return true
+			}
+		}
+		return false
+	}
+}
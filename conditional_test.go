@@ -0,0 +1,128 @@
+package falcore
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPredicates(t *testing.T) {
+	tmp, _ := http.NewRequest("POST", "/api/users", strings.NewReader("{}"))
+	tmp.Header.Set("Content-Type", "application/json; charset=utf-8")
+	tmp.Header.Set("X-Debug", "1")
+	req := NewRequest(tmp, nil, time.Now())
+	res := StringResponse(tmp, 200, http.Header{"Content-Type": {"text/html"}}, "")
+
+	tests := []struct {
+		name     string
+		pred     Predicate
+		res      *http.Response
+		expected bool
+	}{
+		{"path prefix", PathPrefix("/api/"), nil, true},
+		{"other prefix", PathPrefix("/admin/"), nil, false},
+		{"method", Method("GET", "POST"), nil, true},
+		{"other method", Method("GET"), nil, false},
+		{"header present", Header("x-debug"), nil, true},
+		{"header value", Header("X-Debug", "0", "1"), nil, true},
+		{"header other value", Header("X-Debug", "0"), nil, false},
+		{"header missing", Header("X-Other"), nil, false},
+		{"request content type", ContentType("application/json"), nil, true},
+		{"content type wildcard", ContentType("application/*"), nil, true},
+		{"response content type", ContentType("text/*"), res, true},
+		{"response content type mismatch", ContentType("application/json"), res, false},
+		{"not", Not(Method("GET")), nil, true},
+		{"and", And(Method("POST"), PathPrefix("/api/")), nil, true},
+		{"and mismatch", And(Method("POST"), PathPrefix("/admin/")), nil, false},
+		{"or", Or(Method("GET"), PathPrefix("/api/")), nil, true},
+	}
+	for _, test := range tests {
+		if test.pred(req, test.res) != test.expected {
+			t.Errorf("%v: Expected %v", test.name, test.expected)
+		}
+	}
+}
+
+type markFilter string
+
+func (m markFilter) FilterRequest(req *Request) *http.Response {
+	req.HttpRequest.Header.Add("X-Ran", string(m))
+	return nil
+}
+
+func (m markFilter) FilterResponse(req *Request, res *http.Response) {
+	res.Header.Add("X-Ran", string(m))
+}
+
+func TestWhen(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(When(PathPrefix("/admin/"), markFilter("admin")))
+	pipeline.Upstream.PushBack(Unless(Method("GET"), markFilter("write")))
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		h := http.Header{"Content-Type": {"text/plain"}}
+		h["X-Ran"] = req.HttpRequest.Header["X-Ran"]
+		return StringResponse(req.HttpRequest, 200, h, "ok")
+	}))
+	pipeline.Downstream.PushBack(WhenResponse(ContentType("text/html"), markFilter("html")))
+	pipeline.Downstream.PushBack(UnlessResponse(ContentType("text/html"), markFilter("not html")))
+
+	tests := []struct {
+		method   string
+		path     string
+		expected string
+		stages   string // admin, write, html, not html
+	}{
+		{"GET", "/admin/users", "admin,not html", "UP0 UP1 DN1 DN0"},
+		{"POST", "/users", "write,not html", "UP1 UP0 DN1 DN0"},
+		{"GET", "/", "not html", "UP1 UP1 DN1 DN0"},
+	}
+	signatures := make(map[string]bool)
+	for _, test := range tests {
+		tmp, _ := http.NewRequest(test.method, test.path, nil)
+		req, res := TestWithRequest(tmp, pipeline, nil)
+		if ran := strings.Join(res.Header["X-Ran"], ","); ran != test.expected {
+			t.Errorf("%v %v: Expected %q to run, got %q", test.method, test.path, test.expected, ran)
+		}
+
+		// skipped filters are recorded under their own name
+		var stages []string
+		for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+			pss := e.Value.(*PipelineStageStat)
+			if pss.Name == "falcore.markFilter" {
+				stages = append(stages, fmt.Sprintf("%v%v", pss.Type, pss.Status))
+			}
+		}
+		if s := strings.Join(stages, " "); s != test.stages {
+			t.Errorf("%v %v: Expected stages %q, got %q", test.method, test.path, test.stages, s)
+		}
+		signatures[req.Signature()] = true
+	}
+	if len(signatures) != len(tests) {
+		t.Errorf("Expected a different signature for each path, got %v", signatures)
+	}
+}
+
+func TestWhenPanic(t *testing.T) {
+	panics := func(req *Request, res *http.Response) bool { panic("predicate") }
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(When(panics, markFilter("up")))
+	pipeline.Downstream.PushBack(WhenResponse(panics, markFilter("down")))
+
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	req, res := TestWithRequest(tmp, pipeline, nil)
+	if res == nil || res.StatusCode != 500 {
+		t.Fatalf("Expected a 500, got %v", res)
+	}
+	var stages []string
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		pss := e.Value.(*PipelineStageStat)
+		if pss.Name == "falcore.markFilter" {
+			stages = append(stages, fmt.Sprintf("%v%v", pss.Type, pss.Status))
+		}
+	}
+	if s := strings.Join(stages, " "); s != "UP2 DN2" {
+		t.Errorf("Expected the filters' stages to fail, got %q", s)
+	}
+}
@@ -1,4 +1,9 @@
 // Package falcore is a framework for constructing high performance, modular HTTP servers.
 // For more information, see the project page at http://fitstar.github.io/falcore.
 // Or read the full package documentation at http://godoc.org/github.com/fitstar/falcore
+//
+// Besides the Server and Pipeline, the package has helpers for writing
+// filters, like StringResponse and the other response constructors,
+// and HeaderHasToken for checking comma separated headers such as
+// Connection and Upgrade.
 package falcore
@@ -0,0 +1,202 @@
+package falcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Optional interface for RequestFilters that can fail.  The Pipeline
+// calls FilterRequestErr instead of FilterRequest when a filter has
+// it.  A non-nil error stops the Upstream like a response would; the
+// stage is marked as failed and the error is rendered by the
+// Pipeline's ErrorHandler.  Return an *HTTPError to choose the status.
+// Any other error is a 500.
+//
+// Filters should still implement FilterRequest, for use outside of a
+// Pipeline.  NewRequestFilterErr makes one that does.
+type RequestFilterErr interface {
+	FilterRequestErr(req *Request) (*http.Response, error)
+}
+
+// An error that is sent to the client with Status.  Message is shown
+// to the client and defaults to the status text.  Err is the cause;
+// it's logged but not shown.  Header is added to the error response.
+type HTTPError struct {
+	Status  int
+	Message string
+	Err     error
+	Header  http.Header
+}
+
+// An HTTPError with status and a message formatted like fmt.Sprintf
+func NewHTTPError(status int, format string, args ...interface{}) *HTTPError {
+	return &HTTPError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *HTTPError) Error() string {
+	msg := e.message()
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return strconv.Itoa(e.status()) + " " + msg
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+func (e *HTTPError) status() int {
+	if e.Status == 0 {
+		return 500
+	}
+	return e.Status
+}
+
+func (e *HTTPError) message() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return http.StatusText(e.status())
+}
+
+// The HTTPError for err: err itself, or a 500 if it isn't one
+func AsHTTPError(err error) *HTTPError {
+	var he *HTTPError
+	if errors.As(err, &he) {
+		return he
+	}
+	return &HTTPError{Status: 500, Err: err}
+}
+
+// Helper to create a RequestFilterErr by just passing in a func.  Its
+// FilterRequest renders errors with ErrorResponse.
+func NewRequestFilterErr(f func(req *Request) (*http.Response, error)) RequestFilter {
+	return &genericRequestFilterErr{f}
+}
+
+type genericRequestFilterErr struct {
+	f func(req *Request) (*http.Response, error)
+}
+
+func (f *genericRequestFilterErr) FilterRequestErr(req *Request) (*http.Response, error) {
+	return f.f(req)
+}
+
+func (f *genericRequestFilterErr) FilterRequest(req *Request) *http.Response {
+	res, err := f.f(req)
+	if err != nil {
+		return ErrorResponse(req, err)
+	}
+	return res
+}
+
+// Error formats offered to clients, in order of preference when the
+// Accept header doesn't decide
+var errorFormats = []string{"text/plain", "text/html", "application/json", "application/problem+json"}
+
+// The default Pipeline.ErrorHandler.  Renders err as plain text, HTML,
+// JSON or RFC 7807 problem JSON, whichever the request's Accept header
+// prefers.  Errors that aren't HTTPErrors are sent as a 500 without
+// their text.
+func ErrorResponse(req *Request, err error) *http.Response {
+	he := AsHTTPError(err)
+	status, msg := he.status(), he.message()
+	title := http.StatusText(status)
+
+	headers := make(http.Header)
+	for k, v := range he.Header {
+		headers[k] = append([]string(nil), v...)
+	}
+	var body bytes.Buffer
+	format := negotiate(req.HttpRequest.Header.Get("Accept"), errorFormats)
+	switch format {
+	case "text/html":
+		fmt.Fprintf(&body, "<!DOCTYPE html>\n<html><head><title>%d %s</title></head>\n<body><h1>%s</h1>\n<p>%s</p></body></html>\n",
+			status, html.EscapeString(title), html.EscapeString(title), html.EscapeString(msg))
+	case "application/json":
+		json.NewEncoder(&body).Encode(map[string]interface{}{"status": status, "error": msg})
+	case "application/problem+json":
+		problem := map[string]interface{}{"type": "about:blank", "title": title, "status": status}
+		if msg != title {
+			problem["detail"] = msg
+		}
+		json.NewEncoder(&body).Encode(problem)
+	default:
+		body.WriteString(msg + "\n")
+	}
+	headers.Set("Content-Type", format+"; charset=utf-8")
+	b := body.Bytes()
+	return SimpleResponse(req.HttpRequest, status, headers, int64(len(b)), &defaultBody{bytes.NewReader(b)})
+}
+
+// Marks bodies made by ErrorResponse
+type defaultBody struct {
+	*bytes.Reader
+}
+
+func (defaultBody) Close() error {
+	return nil
+}
+
+// Reports whether res has no body, or one falcore generated, like
+// ErrorResponse's and the Pipeline's 404 when no filter answers.
+// Filters such as filter.ErrorPageFilter may replace these without
+// losing anything a filter meant to send.
+func HasDefaultBody(res *http.Response) bool {
+	if res.Body == nil || res.Body == http.NoBody {
+		return true
+	}
+	_, ok := res.Body.(*defaultBody)
+	return ok
+}
+
+// Picks the offer the Accept header likes best.  Ties go to the one
+// listed first in offers.  Returns offers[0] if none are acceptable.
+func negotiate(accept string, offers []string) string {
+	if accept == "" {
+		return offers[0]
+	}
+	best, bestQ, bestSpecificity := offers[0], 0.0, -1
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			params := strings.Split(part, ";")
+			mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+			s := 0
+			switch {
+			case mediaRange == offer:
+				s = 2
+			case mediaRange == "*/*":
+				s = 0
+			case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(offer, mediaRange[:len(mediaRange)-1]):
+				s = 1
+			default:
+				continue
+			}
+			if s < specificity {
+				continue
+			}
+			rq := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						rq = v
+					}
+				}
+			}
+			// the most specific range decides
+			q, specificity = rq, s
+		}
+		if q > bestQ || (q == bestQ && q > 0 && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
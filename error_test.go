@@ -0,0 +1,110 @@
+package falcore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", "text/plain"},
+		{"*/*", "text/plain"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html"},
+		{"application/json", "application/json"},
+		{"application/json;q=0.5, application/problem+json", "application/problem+json"},
+		{"application/*", "application/json"},
+		{"text/*;q=0.1, application/json;q=0.2", "application/json"},
+		{"image/png", "text/plain"},
+	}
+	for _, test := range tests {
+		if f := negotiate(test.accept, errorFormats); f != test.expected {
+			t.Errorf("%q: Expected %v, got %v", test.accept, test.expected, f)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	notFound := &HTTPError{Status: 404, Message: "No such <thing>", Header: http.Header{"X-Error": {"yes"}}}
+	tests := []struct {
+		err    error
+		accept string
+		status int
+		body   string
+	}{
+		{notFound, "", 404, "No such <thing>\n"},
+		{notFound, "text/html", 404, "<!DOCTYPE html>\n<html><head><title>404 Not Found</title></head>\n<body><h1>Not Found</h1>\n<p>No such &lt;thing&gt;</p></body></html>\n"},
+		{notFound, "application/json", 404, "{\"error\":\"No such \\u003cthing\\u003e\",\"status\":404}\n"},
+		{notFound, "application/problem+json", 404, "{\"detail\":\"No such \\u003cthing\\u003e\",\"status\":404,\"title\":\"Not Found\",\"type\":\"about:blank\"}\n"},
+		{errors.New("secret database password"), "", 500, "Internal Server Error\n"},
+		{&HTTPError{Status: 503}, "application/problem+json", 503, "{\"status\":503,\"title\":\"Service Unavailable\",\"type\":\"about:blank\"}\n"},
+	}
+	for _, test := range tests {
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		tmp.Header.Set("Accept", test.accept)
+		res := ErrorResponse(NewRequest(tmp, nil, time.Now()), test.err)
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != test.status || string(body) != test.body {
+			t.Errorf("%v %q: Expected %v %q, got %v %q", test.err, test.accept, test.status, test.body, res.StatusCode, body)
+		}
+		if test.err == notFound && res.Header.Get("X-Error") != "yes" {
+			t.Errorf("%v %q: Expected the error's headers", test.err, test.accept)
+		}
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilterErr(func(req *Request) (*http.Response, error) {
+		if req.HttpRequest.URL.Path == "/missing" {
+			return nil, fmt.Errorf("looking up: %w", NewHTTPError(404, "no %v here", "thing"))
+		}
+		return nil, nil
+	}))
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "found")
+	}))
+	outer := NewPipeline()
+	outer.Upstream.PushBack(inner)
+	outer.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Downstream", "yes")
+	}))
+	// the nested pipeline uses the outer handler
+	outer.ErrorHandler = func(req *Request, err error) *http.Response {
+		he := AsHTTPError(err)
+		return StringResponse(req.HttpRequest, he.Status, nil, "custom: "+he.Message)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+		failed bool
+	}{
+		{"/missing", 404, "custom: no thing here", true},
+		{"/", 200, "found", false},
+	}
+	for _, test := range tests {
+		tmp, _ := http.NewRequest("GET", test.path, nil)
+		req, res := TestWithRequest(tmp, outer, nil)
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != test.status || string(body) != test.body || res.Header.Get("X-Downstream") != "yes" {
+			t.Errorf("%v: Expected %v %q through the Downstream, got %v %q %v", test.path, test.status, test.body, res.StatusCode, body, res.Header)
+		}
+		failed := false
+		for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+			if pss := e.Value.(*PipelineStageStat); pss.Status == 2 && pss.Name == "*falcore.genericRequestFilterErr" {
+				failed = true
+			}
+		}
+		if failed != test.failed {
+			t.Errorf("%v: Expected the stage failed to be %v", test.path, test.failed)
+		}
+	}
+}
@@ -19,24 +19,24 @@ import (
 var ccsrv *falcore.Server
 
 func init() {
-	go func() {
-		// falcore setup
-		pipeline := falcore.NewPipeline()
-		pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
-			for _, data := range ccserverData {
-				if data.path == req.HttpRequest.URL.Path {
-					header := make(http.Header)
-					header.Set("Content-Type", data.mime)
-					header.Set("Content-Encoding", data.encoding)
-					return falcore.StringResponse(req.HttpRequest, 200, header, string(data.body))
-				}
+	// falcore setup
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		for _, data := range ccserverData {
+			if data.path == req.HttpRequest.URL.Path {
+				header := make(http.Header)
+				header.Set("Content-Type", data.mime)
+				header.Set("Content-Encoding", data.encoding)
+				return falcore.StringResponse(req.HttpRequest, 200, header, string(data.body))
 			}
-			return falcore.StringResponse(req.HttpRequest, 404, nil, "Not Found")
-		}))
+		}
+		return falcore.StringResponse(req.HttpRequest, 404, nil, "Not Found")
+	}))
 
-		pipeline.Downstream.PushBack(NewCompressionFilter(nil))
+	pipeline.Downstream.PushBack(NewCompressionFilter(nil))
 
-		ccsrv = falcore.NewServer(0, pipeline)
+	ccsrv = falcore.NewServer(0, pipeline)
+	go func() {
 		if err := ccsrv.ListenAndServe(); err != nil {
 			panic("Could not start falcore")
 		}
@@ -153,12 +153,11 @@ func compress_deflate(body []byte) []byte {
 }
 
 func readfile(path string) []byte {
-	if data, err := ioutil.ReadFile(path); err == nil {
-		return data
-	} else {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
 		panic(fmt.Sprintf("Error reading file %v: %v", path, err))
 	}
-	return nil
+	return data
 }
 
 func ctget(p string, accept string) (r *http.Response, err error) {
@@ -0,0 +1,102 @@
+package filter
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+
+	"github.com/fitstar/falcore"
+)
+
+// A falcore ResponseFilter that replaces the bodies of error responses
+// with custom pages, from static files or templates.  The status code
+// is kept.  Only responses with no body, or the default one falcore
+// generates (see falcore.HasDefaultBody), are changed, so error bodies
+// a filter wrote on purpose, like an API's JSON errors, go out as they
+// are.  This includes the server's 404 for requests no filter answers.
+//
+// Put it in the Downstream before filters like CompressionFilter that
+// work on the body.
+type ErrorPageFilter struct {
+	pages map[int]errorPage
+}
+
+// Type check
+var _ falcore.ResponseFilter = new(ErrorPageFilter)
+
+// What error page templates are executed with
+type ErrorPageData struct {
+	Status     int
+	StatusText string
+	RequestID  string
+	Request    *http.Request
+}
+
+type errorPage struct {
+	contentType string
+	body        []byte
+	tmpl        *template.Template
+}
+
+func NewErrorPageFilter() *ErrorPageFilter {
+	return &ErrorPageFilter{pages: make(map[int]errorPage)}
+}
+
+// Use the file at path as the page for status.  The file is read
+// now; its Content-Type comes from the extension.
+func (f *ErrorPageFilter) AddFile(status int, path string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ct := mime.TypeByExtension(filepath.Ext(path))
+	if ct == "" {
+		ct = http.DetectContentType(body)
+	}
+	f.pages[status] = errorPage{contentType: ct, body: body}
+	return nil
+}
+
+// Render tmpl with an ErrorPageData as the text/html page for status
+func (f *ErrorPageFilter) AddTemplate(status int, tmpl *template.Template) {
+	f.pages[status] = errorPage{contentType: "text/html; charset=utf-8", tmpl: tmpl}
+}
+
+func (f *ErrorPageFilter) FilterResponse(req *falcore.Request, res *http.Response) {
+	req.CurrentStage.Status = 1 // Skip
+	page, ok := f.pages[res.StatusCode]
+	if !ok || !falcore.HasDefaultBody(res) {
+		return
+	}
+
+	body := page.body
+	if page.tmpl != nil {
+		var buf bytes.Buffer
+		data := &ErrorPageData{
+			Status:     res.StatusCode,
+			StatusText: http.StatusText(res.StatusCode),
+			RequestID:  req.ID,
+			Request:    req.HttpRequest,
+		}
+		if err := page.tmpl.Execute(&buf, data); err != nil {
+			falcore.Error("%s Error page template for %d failed: %v", req.ID, res.StatusCode, err)
+			req.CurrentStage.Status = 2 // Fail
+			return
+		}
+		body = buf.Bytes()
+	}
+
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+	res.Header.Del("Content-Length")
+	res.Header.Del("Content-Encoding")
+	res.Header.Set("Content-Type", page.contentType)
+	req.CurrentStage.Status = 0
+}
@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/internal/falcoretest"
+)
+
+func TestErrorPageFilter(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "404.html")
+	ioutil.WriteFile(page, []byte("<h1>Lost?</h1>"), 0600)
+	f := NewErrorPageFilter()
+	if err := f.AddFile(404, page); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddFile(404, page+".missing"); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+	f.AddTemplate(500, template.Must(template.New("500").Parse("{{.Status}} {{.StatusText}} at {{.Request.URL.Path}}")))
+	f.AddTemplate(503, template.Must(template.New("503").Parse("down")))
+
+	srv := falcoretest.StartServer(t, falcore.NewRequestFilterErr(func(req *falcore.Request) (*http.Response, error) {
+		switch req.HttpRequest.URL.Path {
+		case "/error":
+			return nil, fmt.Errorf("something broke")
+		case "/api":
+			return falcore.StringResponse(req.HttpRequest, 404, nil, `{"error":"no such user"}`), nil
+		case "/empty":
+			return falcore.SimpleResponse(req.HttpRequest, 503, nil, 0, nil), nil
+		case "/teapot":
+			return nil, &falcore.HTTPError{Status: 418}
+		}
+		return nil, nil
+	}), func(srv *falcore.Server) {
+		srv.Pipeline.Downstream.PushBack(f)
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		ct     string
+		body   string
+	}{
+		{"/missing", 404, "text/html; charset=utf-8", "<h1>Lost?</h1>"},
+		{"/error", 500, "text/html; charset=utf-8", "500 Internal Server Error at /error"},
+		{"/empty", 503, "text/html; charset=utf-8", "down"},
+		{"/api", 404, "", `{"error":"no such user"}`},
+		{"/teapot", 418, "text/plain; charset=utf-8", "I'm a teapot\n"},
+	}
+	for _, test := range tests {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%v%v", srv.Port(), test.path))
+		if err != nil {
+			t.Fatalf("%v: %v", test.path, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.status || string(body) != test.body || res.Header.Get("Content-Type") != test.ct {
+			t.Errorf("%v: Expected %v %q %q, got %v %q %q", test.path, test.status, test.ct, test.body, res.StatusCode, res.Header.Get("Content-Type"), body)
+		}
+		if res.ContentLength != int64(len(test.body)) {
+			t.Errorf("%v: Expected Content-Length %v, got %v", test.path, len(test.body), res.ContentLength)
+		}
+	}
+}
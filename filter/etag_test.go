@@ -16,23 +16,23 @@ import (
 var esrv *falcore.Server
 
 func init() {
-	go func() {
-		// falcore setup
-		pipeline := falcore.NewPipeline()
-		pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
-			for _, data := range eserverData {
-				if data.path == req.HttpRequest.URL.Path {
-					header := make(http.Header)
-					header.Set("Etag", data.etag)
-					return falcore.StringResponse(req.HttpRequest, data.status, header, string(data.body))
-				}
+	// falcore setup
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		for _, data := range eserverData {
+			if data.path == req.HttpRequest.URL.Path {
+				header := make(http.Header)
+				header.Set("Etag", data.etag)
+				return falcore.StringResponse(req.HttpRequest, data.status, header, string(data.body))
 			}
-			return falcore.StringResponse(req.HttpRequest, 404, nil, "Not Found")
-		}))
+		}
+		return falcore.StringResponse(req.HttpRequest, 404, nil, "Not Found")
+	}))
 
-		pipeline.Downstream.PushBack(new(EtagFilter))
+	pipeline.Downstream.PushBack(new(EtagFilter))
 
-		esrv = falcore.NewServer(0, pipeline)
+	esrv = falcore.NewServer(0, pipeline)
+	go func() {
 		if err := esrv.ListenAndServe(); err != nil {
 			panic("Could not start falcore")
 		}
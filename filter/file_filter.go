@@ -1,6 +1,8 @@
 package filter
 
 import (
+	"errors"
+	"fmt"
 	"github.com/fitstar/falcore"
 	"mime"
 	"net/http"
@@ -18,7 +20,21 @@ type FileFilter struct {
 	PathPrefix string
 }
 
-func (f *FileFilter) FilterRequest(req *falcore.Request) (res *http.Response) {
+// Type check
+var _ falcore.RequestFilterErr = new(FileFilter)
+
+func (f *FileFilter) FilterRequest(req *falcore.Request) *http.Response {
+	res, err := f.FilterRequestErr(req)
+	if err != nil {
+		req.CurrentStage.Status = 2
+		return falcore.ErrorResponse(req, err)
+	}
+	return res
+}
+
+// Returns nil, letting the request continue down the pipeline, if
+// there's no file at the path.  Paths outside PathPrefix are a 404.
+func (f *FileFilter) FilterRequestErr(req *falcore.Request) (res *http.Response, err error) {
 	// Clean asset path
 	asset_path := filepath.Clean(filepath.FromSlash(req.HttpRequest.URL.Path))
 
@@ -26,17 +42,17 @@ func (f *FileFilter) FilterRequest(req *falcore.Request) (res *http.Response) {
 	if strings.HasPrefix(asset_path, f.PathPrefix) {
 		asset_path = asset_path[len(f.PathPrefix):]
 	} else {
-		falcore.Debug("%v doesn't match prefix %v", asset_path, f.PathPrefix)
-		res = falcore.StringResponse(req.HttpRequest, 404, nil, "Not found.")
-		return
+		return nil, &falcore.HTTPError{
+			Status: 404,
+			Err:    fmt.Errorf("%v doesn't match prefix %v", asset_path, f.PathPrefix),
+		}
 	}
 
 	// Resolve FSBase
 	if f.BasePath != "" {
 		asset_path = filepath.Join(f.BasePath, asset_path)
 	} else {
-		falcore.Error("file_filter requires a BasePath")
-		return falcore.StringResponse(req.HttpRequest, 500, nil, "Server Error\n")
+		return nil, errors.New("file_filter requires a BasePath")
 	}
 
 	// Open File
@@ -26,15 +26,14 @@ func init() {
 	mime.AddExtensionType(".txt", "text/plain")
 	mime.AddExtensionType(".png", "image/png")
 
+	// falcore setup
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(&FileFilter{
+		PathPrefix: "/",
+		BasePath:   "../test/",
+	})
+	srv = falcore.NewServer(0, pipeline)
 	go func() {
-
-		// falcore setup
-		pipeline := falcore.NewPipeline()
-		pipeline.Upstream.PushBack(&FileFilter{
-			PathPrefix: "/",
-			BasePath:   "../test/",
-		})
-		srv = falcore.NewServer(0, pipeline)
 		if err := srv.ListenAndServe(); err != nil {
 			panic(fmt.Sprintf("Could not start falcore: %v", err))
 		}
@@ -77,7 +76,7 @@ func TestFourOhFour(t *testing.T) {
 	for _, test := range fourOhFourTests {
 		r, err := get(test.url)
 		if err != nil {
-			t.Errorf("%v Error getting file:", test.name, err)
+			t.Errorf("%v Error getting file: %v", test.name, err)
 			continue
 		}
 		if r.StatusCode != 404 {
@@ -0,0 +1,116 @@
+package filter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/fitstar/falcore"
+)
+
+// Sets Request.ClientIP to the real client's IP when the request came
+// through trusted proxies.  The proxies add the address they got the
+// request from to Header.  Anyone can send that header, so only the hops
+// added by proxies in TrustedProxies are believed.  Set Header to the
+// one your proxies write: no other header is looked at, as a client
+// could send one the proxies leave alone.
+//
+// The filter walks the hops from the newest, starting at the address
+// that connected to us.  The client is the first address that isn't a
+// trusted proxy.  A hop that isn't an IP address, like "unknown" or an
+// obfuscated Forwarded identifier, stops the walk at the proxy that
+// added it.
+//
+// Put it early in the Upstream, before filters that use ClientIP.
+type ForwardedFilter struct {
+	TrustedProxies []*net.IPNet
+	// The header to read the hops from, like Forwarded or X-Real-IP.
+	// Defaults to X-Forwarded-For.
+	Header string
+}
+
+// Type check
+var _ falcore.RequestFilter = new(ForwardedFilter)
+
+// A ForwardedFilter trusting the proxies in trusted, given in CIDR
+// notation or as single IP addresses
+func NewForwardedFilter(trusted ...string) (*ForwardedFilter, error) {
+	nets, err := falcore.ParseCIDRs(trusted...)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardedFilter{TrustedProxies: nets}, nil
+}
+
+func (f *ForwardedFilter) FilterRequest(req *falcore.Request) *http.Response {
+	req.CurrentStage.Status = 0
+	if req.ClientIP == nil || !f.trusted(req.ClientIP) {
+		// not from a proxy, or not one of ours
+		req.CurrentStage.Status = 1
+		return nil
+	}
+	hops := f.hops(req.HttpRequest.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			break
+		}
+		req.ClientIP = ip
+		if !f.trusted(ip) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *ForwardedFilter) trusted(ip net.IP) bool {
+	for _, n := range f.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The hops in Header, oldest first
+func (f *ForwardedFilter) hops(header http.Header) []string {
+	name := f.Header
+	if name == "" {
+		name = "X-Forwarded-For"
+	}
+	var hops []string
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, element := range strings.Split(v, ",") {
+			element = strings.TrimSpace(element)
+			if strings.EqualFold(name, "Forwarded") {
+				element = forwardedFor(element)
+			}
+			hops = append(hops, element)
+		}
+	}
+	return hops
+}
+
+// The for= parameter of one Forwarded element, unquoted.  Empty if
+// there isn't one.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		pair = strings.TrimSpace(pair)
+		if i := strings.Index(pair, "="); i > 0 && strings.EqualFold(pair[:i], "for") {
+			return strings.Trim(pair[i+1:], `"`)
+		}
+	}
+	return ""
+}
+
+// Parses a hop like "192.0.2.1", "192.0.2.1:4711", "2001:db8::1" or
+// "[2001:db8::1]:4711".  Nil if it isn't an IP address.
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
@@ -0,0 +1,59 @@
+package filter
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fitstar/falcore"
+)
+
+func TestForwardedFilter(t *testing.T) {
+	f, err := NewForwardedFilter("10.0.0.0/8", "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		use      string
+		remote   string
+		header   http.Header
+		expected string
+	}{
+		{"untrusted peer", "", "192.0.2.9:1234", http.Header{"X-Forwarded-For": {"192.0.2.1"}}, "192.0.2.9"},
+		{"no header", "", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"xff", "", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"192.0.2.1"}}, "192.0.2.1"},
+		{"xff spoofed", "", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"6.6.6.6, 192.0.2.1, 10.0.0.2"}}, "192.0.2.1"},
+		{"xff several headers", "", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"6.6.6.6", "192.0.2.1:5555"}}, "192.0.2.1"},
+		{"xff all trusted", "", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"xff garbage", "", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"192.0.2.1, garbage"}}, "10.0.0.1"},
+		{"real ip", "X-Real-IP", "10.0.0.1:1234", http.Header{"X-Real-Ip": {"192.0.2.1"}}, "192.0.2.1"},
+		{"forwarded", "Forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {`for=6.6.6.6, for="[2001:db8::2]:4711";proto=https, for=10.0.0.2;by=10.0.0.1`}}, "2001:db8::2"},
+		{"forwarded obfuscated", "Forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {"for=192.0.2.1, for=_hidden"}}, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		f.Header = test.use
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		tmp.RemoteAddr = test.remote
+		for k, v := range test.header {
+			tmp.Header[k] = v
+		}
+		req, _ := falcore.TestWithRequest(tmp, f, nil)
+		if req.ClientIP.String() != test.expected {
+			t.Errorf("%v: Expected client %v, got %v", test.name, test.expected, req.ClientIP)
+		}
+	}
+
+	// only the configured header is read, even when it's missing
+	for _, use := range []string{"", "Forwarded"} {
+		f.Header = use
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		tmp.RemoteAddr = "10.0.0.1:1234"
+		tmp.Header.Set("X-Real-IP", "6.6.6.6")
+		if use == "" {
+			tmp.Header.Set("Forwarded", "for=6.6.6.6")
+		}
+		if req, _ := falcore.TestWithRequest(tmp, f, nil); req.ClientIP.String() != "10.0.0.1" {
+			t.Errorf("%q: Expected other headers to be ignored, got %v", use, req.ClientIP)
+		}
+	}
+}
@@ -3,13 +3,16 @@ package filter
 import (
 	"fmt"
 	"github.com/fitstar/falcore"
-	"io"
 	"net/http"
+	"strings"
 )
 
 // Implements a RequestFilter using a http.Handler to produce the response
 // This will always return a response due to the requirements of the http.Handler
 // interface so it should be placed at the end of the Upstream pipeline.
+// The ResponseWriter implements http.Flusher, so handlers can stream.
+// Trailers work as with net/http: declare them in the Trailer header
+// before writing, or set headers prefixed with http.TrailerPrefix.
 type HandlerFilter struct {
 	handler http.Handler
 }
@@ -31,16 +34,18 @@ func (h *HandlerFilter) FilterRequest(req *falcore.Request) *http.Response {
 
 // copied from net/http/filetransport.go
 func newPopulateResponseWriter(req *http.Request) (*populateResponse, <-chan *http.Response) {
-	pr, pw := io.Pipe()
+	body, sw := falcore.NewStreamBody()
 	rw := &populateResponse{
-		ch: make(chan *http.Response),
-		pw: pw,
+		ch:     make(chan *http.Response),
+		sw:     sw,
+		header: make(http.Header),
 		res: &http.Response{
-			Proto:      "HTTP/1.0",
+			Proto:      "HTTP/1.1",
 			ProtoMajor: 1,
+			ProtoMinor: 1,
 			Header:     make(http.Header),
 			Close:      true,
-			Body:       pr,
+			Body:       body,
 			Request:    req,
 		},
 	}
@@ -51,23 +56,34 @@ func newPopulateResponseWriter(req *http.Request) (*populateResponse, <-chan *ht
 // in res, and writes its body to a pipe connected to the response
 // body. Once writes begin or finish() is called, the response is sent
 // on ch.
+//
+// The handler's header is copied into res when it's sent so the
+// handler can go on setting trailers while the server writes.
 type populateResponse struct {
+	header       http.Header
 	res          *http.Response
 	ch           chan *http.Response
 	wroteHeader  bool
 	hasContent   bool
 	sentResponse bool
-	pw           *io.PipeWriter
+	finished     bool
+	sw           *falcore.StreamWriter
 }
 
+var _ http.Flusher = new(populateResponse)
+
 func (pr *populateResponse) finish() {
 	if !pr.wroteHeader {
 		pr.WriteHeader(500)
 	}
+	pr.finished = true
 	if !pr.sentResponse {
 		pr.sendResponse()
+	} else {
+		// the server is waiting on the body, so it's safe to touch res
+		pr.setTrailers()
 	}
-	pr.pw.Close()
+	pr.sw.Close()
 }
 
 func (pr *populateResponse) sendResponse() {
@@ -79,11 +95,51 @@ func (pr *populateResponse) sendResponse() {
 	if pr.hasContent {
 		pr.res.ContentLength = -1
 	}
+	pr.res.Header = pr.header.Clone()
+	pr.declareTrailers()
+	if pr.finished {
+		pr.setTrailers()
+	}
 	pr.ch <- pr.res
 }
 
+// Moves trailers declared in the Trailer header from the response
+// header to res.Trailer
+func (pr *populateResponse) declareTrailers() {
+	h := pr.res.Header
+	pr.res.Trailer = make(http.Header)
+	for _, v := range h["Trailer"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = http.CanonicalHeaderKey(strings.TrimSpace(key)); key != "" {
+				pr.res.Trailer[key] = nil
+				h.Del(key)
+			}
+		}
+	}
+	h.Del("Trailer")
+	for key := range h {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			delete(h, key)
+		}
+	}
+}
+
+// Copies the handler's trailer values into res.Trailer
+func (pr *populateResponse) setTrailers() {
+	for key := range pr.res.Trailer {
+		if v, ok := pr.header[key]; ok {
+			pr.res.Trailer[key] = v
+		}
+	}
+	for key, v := range pr.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			pr.res.Trailer[http.CanonicalHeaderKey(key[len(http.TrailerPrefix):])] = v
+		}
+	}
+}
+
 func (pr *populateResponse) Header() http.Header {
-	return pr.res.Header
+	return pr.header
 }
 
 func (pr *populateResponse) WriteHeader(code int) {
@@ -104,5 +160,19 @@ func (pr *populateResponse) Write(p []byte) (n int, err error) {
 	if !pr.sentResponse {
 		pr.sendResponse()
 	}
-	return pr.pw.Write(p)
+	return pr.sw.Write(p)
+}
+
+// Sends the headers, if they haven't been, and everything written so
+// far to the client.
+func (pr *populateResponse) Flush() {
+	if !pr.wroteHeader {
+		pr.WriteHeader(http.StatusOK)
+	}
+	// the body is streamed from here on
+	pr.hasContent = true
+	if !pr.sentResponse {
+		pr.sendResponse()
+	}
+	pr.sw.Flush()
 }
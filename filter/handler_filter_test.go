@@ -1,8 +1,10 @@
 package filter
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/internal/falcoretest"
 	"io/ioutil"
 	"net/http"
 	"testing"
@@ -11,7 +13,7 @@ import (
 func TestHandlerFilter(t *testing.T) {
 	reply := "Hello, World"
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, reply)
+		fmt.Fprint(w, reply)
 	}
 
 	hff := NewHandlerFilter(http.HandlerFunc(handler))
@@ -30,3 +32,61 @@ func TestHandlerFilter(t *testing.T) {
 	}
 
 }
+
+func TestHandlerFilterFlush(t *testing.T) {
+	next := make(chan bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-next
+		fmt.Fprint(w, "second\n")
+	}
+	srv := falcoretest.StartServer(t, NewHandlerFilter(http.HandlerFunc(handler)), nil)
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%v/", srv.Port()))
+	if err != nil {
+		t.Fatalf("Couldn't get: %v", err)
+	}
+	defer res.Body.Close()
+	br := bufio.NewReader(res.Body)
+	// blocks forever if the flush didn't make it to the client
+	if line, err := br.ReadString('\n'); line != "first\n" {
+		t.Fatalf("Expected first line, got %q %v", line, err)
+	}
+	close(next)
+	if rest, _ := ioutil.ReadAll(br); string(rest) != "second\n" {
+		t.Errorf("Expected second line, got %q", rest)
+	}
+}
+
+func TestHandlerFilterTrailers(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Declared")
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "body")
+		w.Header().Set("X-Declared", "declared")
+		w.Header().Set(http.TrailerPrefix+"X-Prefixed", "prefixed")
+	}
+	srv := falcoretest.StartServer(t, NewHandlerFilter(http.HandlerFunc(handler)), nil)
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%v/", srv.Port()))
+	if err != nil {
+		t.Fatalf("Couldn't get: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "body" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	for key, v := range map[string]string{"X-Declared": "declared", "X-Prefixed": "prefixed"} {
+		if got := res.Trailer.Get(key); got != v {
+			t.Errorf("Expected trailer %v: %q, got %q", key, v, got)
+		}
+		if got := res.Header.Get(key); got != "" {
+			t.Errorf("Trailer %v shouldn't be in the header, got %q", key, got)
+		}
+	}
+}
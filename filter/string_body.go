@@ -29,7 +29,13 @@ func (sbf *StringBodyFilter) FilterRequest(request *falcore.Request) *http.Respo
 	req := request.HttpRequest
 	// This caches the request body so that multiple filters can iterate it
 	if req.Method == "POST" || req.Method == "PUT" {
-		sb, err := sbf.readRequestBody(req)
+		sb, err := sbf.readRequestBody(req, request.MaxBodyBytes())
+		if err == falcore.ErrBodyTooLarge {
+			request.CurrentStage.Status = 2 // Fail
+			res := falcore.StringResponse(req, 413, nil, "Request Entity Too Large\n")
+			res.Close = true
+			return res
+		}
 		if sb == nil || err != nil {
 			request.CurrentStage.Status = 3 // Skip
 			falcore.Debug("%s No Req Body or Ignored: %v", request.ID, err)
@@ -42,17 +48,24 @@ func (sbf *StringBodyFilter) FilterRequest(request *falcore.Request) *http.Respo
 
 // reads the request body and replaces the buffer with self
 // returns nil if the body is multipart and not replaced
-func (sbf *StringBodyFilter) readRequestBody(r *http.Request) (sb *StringBody, err error) {
+// bodies over maxBytes (DefaultMaxBodyBytes if zero) return ErrBodyTooLarge
+func (sbf *StringBodyFilter) readRequestBody(r *http.Request, maxBytes int64) (sb *StringBody, err error) {
 	ct := r.Header.Get("Content-Type")
 	// leave it on the buffer if we're multipart
 	if strings.SplitN(ct, ";", 2)[0] != "multipart/form-data" && r.ContentLength > 0 {
+		if maxBytes <= 0 {
+			maxBytes = falcore.DefaultMaxBodyBytes
+		}
 		sb = &StringBody{}
-		const maxFormSize = int64(10 << 20) // 10 MB is a lot of text.
-		sb.bpe = sbf.pool.Take(io.LimitReader(r.Body, maxFormSize+1))
+		sb.bpe = sbf.pool.Take(io.LimitReader(r.Body, maxBytes+1))
 
 		// There shouldn't be a null byte so we should get EOF
 		b, e := sb.bpe.Br.ReadBytes(0)
+		if e == io.EOF && int64(len(b)) > maxBytes {
+			e = falcore.ErrBodyTooLarge
+		}
 		if e != nil && e != io.EOF {
+			sbf.pool.Give(sb.bpe)
 			return nil, e
 		}
 		sb.BodyBuffer = bytes.NewReader(b)
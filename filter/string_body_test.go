@@ -79,3 +79,23 @@ func BenchmarkStringBody(b *testing.B) {
 		b.StopTimer()
 	}
 }
+
+func TestStringBodyTooLarge(t *testing.T) {
+	pipeline := falcore.NewPipeline()
+	pipeline.MaxBodyBytes = 8
+	pipeline.Upstream.PushBack(NewStringBodyFilter())
+
+	body := []byte("HOT HOT HOT!!!")
+	tmp, _ := http.NewRequest("POST", "/hello", bytes.NewReader(body))
+	tmp.Header.Set("Content-Type", "text/plain")
+	// lie about the length so the limit is hit while reading
+	tmp.ContentLength = 4
+
+	_, res := falcore.TestWithRequest(tmp, pipeline, nil)
+	if res == nil || res.StatusCode != 413 {
+		t.Fatalf("Expected 413, got %v", res)
+	}
+	if !res.Close {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
@@ -31,6 +31,9 @@ type Upstream struct {
 	throttleQueue    int64
 }
 
+// Type check
+var _ falcore.RequestFilterErr = new(Upstream)
+
 func NewUpstream(transport *UpstreamTransport) *Upstream {
 	u := new(Upstream)
 	u.Transport = transport
@@ -38,8 +41,18 @@ func NewUpstream(transport *UpstreamTransport) *Upstream {
 	return u
 }
 
-func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response) {
-	var err error
+func (u *Upstream) FilterRequest(request *falcore.Request) *http.Response {
+	res, err := u.FilterRequestErr(request)
+	if err != nil {
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.ErrorResponse(request, err)
+	}
+	return res
+}
+
+// Fails with a 504 if the upstream times out and a 502 for other
+// errors talking to it
+func (u *Upstream) FilterRequestErr(request *falcore.Request) (res *http.Response, err error) {
 	req := request.HttpRequest
 
 	if u.Name != "" {
@@ -80,7 +93,7 @@ func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response)
 		if upstrRes.ContentLength > 0 {
 			res.ContentLength = upstrRes.ContentLength
 			res.Body = upstrRes.Body
-		} else if res.ContentLength == -1 {
+		} else if upstrRes.ContentLength == -1 {
 			res.Body = upstrRes.Body
 			res.ContentLength = -1
 			res.TransferEncoding = []string{"chunked"}
@@ -112,20 +125,23 @@ func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response)
 			case "Content-Length":
 			case "Connection":
 			case "Transfer-Encoding":
+			case "Trailer":
 			default:
 				res.Header[hn] = hv
 			}
 		}
+		// Filled in by the transport once the body has been read,
+		// in time for the server to write them after the body.
+		res.Trailer = upstrRes.Trailer
 	} else {
 		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 			falcore.Error("%s [%s] Upstream Timeout error: %v", request.ID, u.Name, err)
-			res = falcore.StringResponse(req, 504, nil, "Gateway Timeout\n")
-			request.CurrentStage.Status = 2 // Fail
+			err = &falcore.HTTPError{Status: 504, Err: err}
 		} else {
 			falcore.Error("%s [%s] Upstream error: %v", request.ID, u.Name, err)
-			res = falcore.StringResponse(req, 502, nil, "Bad Gateway\n")
-			request.CurrentStage.Status = 2 // Fail
+			err = &falcore.HTTPError{Status: 502, Err: err}
 		}
+		return nil, err
 	}
 	falcore.Debug("%s %s [%s] [%s] %s s=%d Time=%.4f", request.ID, u.Name, req.Method, u.Transport.host, req.URL, res.StatusCode, diff)
 	return
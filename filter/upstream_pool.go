@@ -62,16 +62,24 @@ func (up UpstreamPool) LogStatus() {
 	}
 }
 
-func (up UpstreamPool) FilterRequest(req *falcore.Request) (res *http.Response) {
+func (up UpstreamPool) FilterRequest(req *falcore.Request) *http.Response {
+	res, err := up.FilterRequestErr(req)
+	if err != nil {
+		req.CurrentStage.Status = 2 // Fail
+		return falcore.ErrorResponse(req, err)
+	}
+	return res
+}
+
+func (up UpstreamPool) FilterRequestErr(req *falcore.Request) (*http.Response, error) {
 	ue := up.Next()
-	res = ue.Upstream.FilterRequest(req)
-	if req.CurrentStage.Status == 2 {
-		// this gets set by the upstream for errors
-		// so mark this upstream as down
+	res, err := ue.Upstream.FilterRequestErr(req)
+	if err != nil {
+		// mark this upstream as down
 		up.updateUpstream(ue, 0)
 		up.LogStatus()
 	}
-	return
+	return res, err
 }
 
 func (up UpstreamPool) updateUpstream(ue *UpstreamEntry, wgt int) {
@@ -1,8 +1,11 @@
 package filter
 
 import (
+	"fmt"
 	"github.com/fitstar/falcore"
+	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
 	"testing"
 	"time"
@@ -35,7 +38,7 @@ func TestUpstreamThrottle(t *testing.T) {
 
 		for j := 0; j < 10; j++ {
 			go func() {
-				req, _ := http.NewRequest("GET", "/", nil)
+				req, _ := http.NewRequest("GET", "http://localhost/", nil)
 				_, res := falcore.TestWithRequest(req, up, nil)
 				resCh <- res
 				// fmt.Println("OK")
@@ -58,3 +61,75 @@ func TestUpstreamThrottle(t *testing.T) {
 	}
 
 }
+
+func TestUpstreamTrailers(t *testing.T) {
+	// Upstream server that sends a trailer
+	trailerPipe := falcore.NewPipeline()
+	trailerPipe.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		res := falcore.StringResponse(req.HttpRequest, 200, nil, "OK")
+		res.Trailer = http.Header{"Grpc-Status": {"0"}}
+		return res
+	}))
+	trailerSrv := falcore.NewServer(0, trailerPipe)
+	go trailerSrv.ListenAndServe()
+	<-trailerSrv.AcceptReady
+	defer trailerSrv.StopAccepting()
+
+	// Proxy in front of it
+	proxyPipe := falcore.NewPipeline()
+	proxyPipe.Upstream.PushBack(NewUpstream(NewUpstreamTransport("localhost", trailerSrv.Port(), 0, nil)))
+	proxySrv := falcore.NewServer(0, proxyPipe)
+	go proxySrv.ListenAndServe()
+	<-proxySrv.AcceptReady
+	defer proxySrv.StopAccepting()
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%v/", proxySrv.Port()))
+	if err != nil {
+		t.Fatalf("Couldn't get: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "OK" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if v := res.Trailer.Get("Grpc-Status"); v != "0" {
+		t.Errorf("Expected Grpc-Status trailer 0, got %q", v)
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	// nothing listens on a port we just closed
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	up := NewUpstream(NewUpstreamTransport("localhost", port, time.Second, nil))
+
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	_, err = up.FilterRequestErr(falcore.NewRequest(req, nil, time.Now()))
+	if he, ok := err.(*falcore.HTTPError); !ok || he.Status != 502 {
+		t.Errorf("Expected a 502 HTTPError, got %v", err)
+	}
+
+	// rendered by the pipeline
+	pipe := falcore.NewPipeline()
+	pipe.Upstream.PushBack(up)
+	req, _ = http.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Accept", "application/json")
+	freq, res := falcore.TestWithRequest(req, pipe, nil)
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 502 || string(body) != "{\"error\":\"Bad Gateway\",\"status\":502}\n" {
+		t.Errorf("Expected a JSON 502, got %v %q", res.StatusCode, body)
+	}
+	failed := false
+	for e := freq.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		if e.Value.(*falcore.PipelineStageStat).Status == 2 {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Errorf("Expected the upstream stage to be marked as failed")
+	}
+}
@@ -0,0 +1,369 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fitstar/falcore"
+)
+
+// Message types.  Ping, pong and close messages are control messages
+// and are handled by ReadMessage itself.
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// Close status codes from RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005
+	CloseInvalidPayloadData = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseInternalServerErr  = 1011
+)
+
+// Used when Filter.MaxMessageSize is zero
+const DefaultMaxMessageSize = 1 << 20 // 1 MB
+
+// How long Close waits for the peer to answer the close handshake
+var closeTimeout = 5 * time.Second
+
+// Returned by the write methods once a close frame has been sent
+var ErrCloseSent = errors.New("websocket: close sent")
+
+// Returned by ReadMessage once the connection is closing.  Code is the
+// status the peer sent, or the one we failed the connection with.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// A server side WebSocket connection.  Messages are read and written
+// whole; fragmented messages are reassembled and control frames are
+// answered as they arrive.
+//
+// One goroutine may read while another writes.  Writes from several
+// goroutines are serialized.
+type Conn struct {
+	// The handshake request
+	Request *falcore.Request
+	// The negotiated subprotocol, if any
+	Subprotocol string
+	// Largest message ReadMessage will accept.  Bigger messages fail
+	// the connection with CloseMessageTooBig.
+	MaxMessageSize int64
+	// If set, WriteMessage splits messages into frames of at most this
+	// many bytes
+	FragmentSize int
+	// Called with the payload of each pong
+	PongHandler func(data []byte)
+
+	conn       net.Conn
+	br         *bufio.Reader
+	bw         *bufio.Writer
+	writeMutex sync.Mutex
+	closeSent  bool
+	readErr    error
+}
+
+func newConn(c net.Conn, br *bufio.Reader, bw *bufio.Writer) *Conn {
+	return &Conn{
+		MaxMessageSize: DefaultMaxMessageSize,
+		conn:           c,
+		br:             br,
+		bw:             bw,
+	}
+}
+
+// Reads the next text or binary message.  Pings are answered and pongs
+// passed to PongHandler along the way.  When the peer closes the
+// connection, its close frame is echoed and a *CloseError is returned.
+// Protocol violations by the peer fail the connection and also return
+// a *CloseError.
+func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	for {
+		fin, op, payload, err := c.readFrame(int64(len(p)))
+		if err != nil {
+			return 0, nil, c.readFailed(err)
+		}
+		switch op {
+		case PingMessage:
+			if err := c.writeControl(PongMessage, payload); err != nil && err != ErrCloseSent {
+				return 0, nil, c.readFailed(err)
+			}
+			continue
+		case PongMessage:
+			if c.PongHandler != nil {
+				c.PongHandler(payload)
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.readFailed(c.peerClosed(payload))
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.readFailed(&CloseError{CloseProtocolError, "unexpected continuation frame"})
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.readFailed(&CloseError{CloseProtocolError, "expected continuation frame"})
+			}
+			messageType = op
+		default:
+			return 0, nil, c.readFailed(&CloseError{CloseProtocolError, fmt.Sprintf("unknown opcode %d", op)})
+		}
+
+		p = append(p, payload...)
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(p) {
+				return 0, nil, c.readFailed(&CloseError{CloseInvalidPayloadData, "invalid UTF-8"})
+			}
+			return messageType, p, nil
+		}
+	}
+}
+
+// Reads one frame.  read is the size of the message so far.
+func (c *Conn) readFrame(read int64) (fin bool, op int, payload []byte, err error) {
+	var h [8]byte
+	if _, err = io.ReadFull(c.br, h[:2]); err != nil {
+		return
+	}
+	fin = h[0]&0x80 != 0
+	op = int(h[0] & 0x0f)
+	if h[0]&0x70 != 0 {
+		return fin, op, nil, &CloseError{CloseProtocolError, "reserved bits set"}
+	}
+	if h[1]&0x80 == 0 {
+		return fin, op, nil, &CloseError{CloseProtocolError, "unmasked client frame"}
+	}
+
+	n := int64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		if _, err = io.ReadFull(c.br, h[:2]); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.br, h[:8]); err != nil {
+			return
+		}
+		if h[0]&0x80 != 0 {
+			return fin, op, nil, &CloseError{CloseProtocolError, "bad frame length"}
+		}
+		n = int64(binary.BigEndian.Uint64(h[:8]))
+	}
+
+	if op >= CloseMessage {
+		if !fin || n > 125 {
+			return fin, op, nil, &CloseError{CloseProtocolError, "bad control frame"}
+		}
+	} else if n > c.MaxMessageSize-read {
+		return fin, op, nil, &CloseError{CloseMessageTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// Handles a close frame from the peer.  Echoes its status and returns
+// the error ReadMessage should report.
+func (c *Conn) peerClosed(payload []byte) error {
+	if len(payload) == 0 {
+		c.writeClose(nil)
+		return &CloseError{CloseNoStatusReceived, ""}
+	}
+	if len(payload) == 1 {
+		return &CloseError{CloseProtocolError, "bad close frame"}
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	if !validCloseCode(code) {
+		return &CloseError{CloseProtocolError, fmt.Sprintf("bad close code %d", code)}
+	}
+	if !utf8.Valid(payload[2:]) {
+		return &CloseError{CloseInvalidPayloadData, "invalid UTF-8 in close reason"}
+	}
+	c.writeClose(payload[:2])
+	return &CloseError{code, string(payload[2:])}
+}
+
+// Remembers why reading stopped.  If the peer broke the protocol, the
+// connection is failed with the matching close code.
+func (c *Conn) readFailed(err error) error {
+	if ce, ok := err.(*CloseError); ok && ce.Code != CloseNoStatusReceived {
+		c.writeClose(closePayload(ce.Code, ce.Text))
+	}
+	c.readErr = err
+	return err
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+func closePayload(code int, text string) []byte {
+	p := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	return append(p, text...)
+}
+
+// Sends a text or binary message
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: can't write message type %d", messageType)
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	op := messageType
+	for {
+		frame := data
+		if c.FragmentSize > 0 && len(frame) > c.FragmentSize {
+			frame = frame[:c.FragmentSize]
+		}
+		data = data[len(frame):]
+		if err := c.writeFrame(len(data) == 0, op, frame); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return c.bw.Flush()
+		}
+		op = continuationFrame
+	}
+}
+
+// Sends a ping.  The peer's pong is passed to PongHandler by
+// ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(PingMessage, data)
+}
+
+func (c *Conn) writeControl(op int, data []byte) error {
+	if len(data) > 125 {
+		return errors.New("websocket: control frame payload too long")
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if err := c.writeFrame(true, op, data); err != nil {
+		return err
+	}
+	if op == CloseMessage {
+		// nothing may follow the close frame
+		c.closeSent = true
+	}
+	return c.bw.Flush()
+}
+
+// Sends a close frame, unless one has been sent already
+func (c *Conn) writeClose(payload []byte) error {
+	return c.writeControl(CloseMessage, payload)
+}
+
+// Writes an unmasked frame header and payload.  Call with writeMutex held.
+func (c *Conn) writeFrame(fin bool, op int, data []byte) error {
+	var h [10]byte
+	h[0] = byte(op)
+	if fin {
+		h[0] |= 0x80
+	}
+	n := 2
+	switch {
+	case len(data) < 126:
+		h[1] = byte(len(data))
+	case len(data) <= 0xffff:
+		h[1] = 126
+		binary.BigEndian.PutUint16(h[2:], uint16(len(data)))
+		n = 4
+	default:
+		h[1] = 127
+		binary.BigEndian.PutUint64(h[2:], uint64(len(data)))
+		n = 10
+	}
+	if _, err := c.bw.Write(h[:n]); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(data)
+	return err
+}
+
+// Closes the connection with CloseNormalClosure
+func (c *Conn) Close() error {
+	return c.CloseWithStatus(CloseNormalClosure, "")
+}
+
+// Runs the close handshake and closes the underlying connection.
+// Unless the peer already closed, messages that arrive while waiting
+// for its close frame are discarded.  Since it reads, CloseWithStatus
+// must not be called while another goroutine is in ReadMessage.
+func (c *Conn) CloseWithStatus(code int, text string) error {
+	if c.writeClose(closePayload(code, text)) == nil && c.readErr == nil {
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for c.readErr == nil {
+			c.ReadMessage()
+		}
+	}
+	return c.conn.Close()
+}
+
+// Sets the deadline for reads from the underlying connection
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Sets the deadline for writes to the underlying connection
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
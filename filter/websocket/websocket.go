@@ -0,0 +1,171 @@
+// Package websocket implements RFC 6455 WebSockets as a falcore filter.
+//
+// A Filter answers WebSocket handshakes and hands each new connection
+// to a Handler.  Requests that aren't WebSocket handshakes are passed
+// on, so the filter can sit anywhere in a Pipeline or behind a
+// router route:
+//
+//	echo := websocket.NewFilter(func(c *websocket.Conn) {
+//		defer c.Close()
+//		for {
+//			mt, msg, err := c.ReadMessage()
+//			if err != nil {
+//				return
+//			}
+//			c.WriteMessage(mt, msg)
+//		}
+//	})
+//	router.AddMatch("^/echo$", echo)
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+
+	"github.com/fitstar/falcore"
+)
+
+// Mixed into Sec-WebSocket-Key to produce Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Called with each established connection, in its own goroutine.  The
+// handler owns the connection and should Close it when it's done.
+type Handler func(c *Conn)
+
+// Upgrades WebSocket handshake requests and runs Handler on the
+// resulting connections.  Other requests get a nil response.
+type Filter struct {
+	Handler Handler
+	// Subprotocols the server supports, in order of preference.  The
+	// first one the client also asked for is selected.
+	Subprotocols []string
+	// Decides whether to accept a handshake based on its Origin.  The
+	// default accepts requests without an Origin and requests whose
+	// Origin host matches the Host header.
+	CheckOrigin func(req *falcore.Request) bool
+	// Largest message ReadMessage will accept.  Zero uses
+	// DefaultMaxMessageSize.
+	MaxMessageSize int64
+	// If set, WriteMessage splits messages into frames of at most
+	// this many bytes.
+	FragmentSize int
+}
+
+func NewFilter(handler Handler) *Filter {
+	return &Filter{Handler: handler}
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	if req.Method != "GET" || !falcore.HeaderHasToken(req.Header, "Connection", "upgrade") ||
+		!falcore.HeaderHasToken(req.Header, "Upgrade", "websocket") {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		request.CurrentStage.Status = 2 // Fail
+		res := falcore.StringResponse(req, 426, nil, "Unsupported WebSocket version\n")
+		res.Header.Set("Sec-WebSocket-Version", "13")
+		return res
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.StringResponse(req, 400, nil, "Bad Sec-WebSocket-Key\n")
+	}
+	checkOrigin := f.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(request) {
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.StringResponse(req, 403, nil, "Origin not allowed\n")
+	}
+
+	netConn, rw, err := request.Hijack()
+	if err != nil {
+		falcore.Error("%s websocket: couldn't hijack connection: %v", request.ID, err)
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.StringResponse(req, 500, nil, "Internal Server Error\n")
+	}
+
+	protocol := f.selectSubprotocol(req)
+	header := make(http.Header)
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", acceptKey(key))
+	if protocol != "" {
+		header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		falcore.Debug("%s websocket: handshake failed: %v", request.ID, err)
+		netConn.Close()
+		return nil
+	}
+
+	c := newConn(netConn, rw.Reader, rw.Writer)
+	c.Request = request
+	c.Subprotocol = protocol
+	if f.MaxMessageSize > 0 {
+		c.MaxMessageSize = f.MaxMessageSize
+	}
+	c.FragmentSize = f.FragmentSize
+	go f.serve(c)
+	return nil
+}
+
+// Runs the Handler.  A panic closes the connection instead of taking
+// down the server.
+func (f *Filter) serve(c *Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			falcore.Error("%s websocket: PANIC in handler: %v\n%s", c.Request.ID, err, debug.Stack())
+			c.conn.Close()
+		}
+	}()
+	f.Handler(c)
+}
+
+func (f *Filter) selectSubprotocol(req *http.Request) string {
+	var requested []string
+	for _, v := range req.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		for _, p := range strings.Split(v, ",") {
+			requested = append(requested, strings.TrimSpace(p))
+		}
+	}
+	for _, s := range f.Subprotocols {
+		for _, p := range requested {
+			if s == p {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func sameOrigin(request *falcore.Request) bool {
+	origin := request.HttpRequest.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, request.HttpRequest.Host)
+}
@@ -0,0 +1,286 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/internal/falcoretest"
+	"github.com/fitstar/falcore/router"
+)
+
+// A bare bones client for exercising the server side
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func echoHandler(c *Conn) {
+	defer c.Close()
+	for {
+		mt, msg, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.WriteMessage(mt, msg)
+	}
+}
+
+func startServer(t *testing.T, ws *Filter) *falcore.Server {
+	r := router.NewPathRouter()
+	r.AddMatch("^/ws$", ws)
+	return falcoretest.StartServer(t, nil, func(srv *falcore.Server) {
+		srv.Pipeline.Upstream.PushBack(r)
+		srv.Pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+			return falcore.StringResponse(req.HttpRequest, 200, nil, "not a websocket")
+		}))
+	})
+}
+
+func dial(t *testing.T, srv *falcore.Server, header string) (*testClient, *http.Response) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n%s\r\n", header)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Couldn't read handshake response: %v", err)
+	}
+	return &testClient{t, conn, br}, res
+}
+
+func (c *testClient) writeFrame(b0 byte, payload []byte) {
+	var buf bytes.Buffer
+	buf.WriteByte(b0)
+	switch {
+	case len(payload) < 126:
+		buf.WriteByte(0x80 | byte(len(payload)))
+	default:
+		buf.WriteByte(0x80 | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	buf.Write(mask)
+	for i, b := range payload {
+		buf.WriteByte(b ^ mask[i%4])
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatalf("Couldn't write frame: %v", err)
+	}
+}
+
+func (c *testClient) readFrame() (byte, []byte) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		c.t.Fatalf("Couldn't read frame: %v", err)
+	}
+	n := int(h[1] & 0x7f)
+	if n == 126 {
+		var l uint16
+		binary.Read(c.br, binary.BigEndian, &l)
+		n = int(l)
+	}
+	payload := make([]byte, n)
+	io.ReadFull(c.br, payload)
+	return h[0], payload
+}
+
+func TestHandshake(t *testing.T) {
+	srv := startServer(t, &Filter{Handler: echoHandler, Subprotocols: []string{"chat", "superchat"}})
+	_, res := dial(t, srv, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: superchat, chat\r\n")
+	if res.StatusCode != 101 {
+		t.Fatalf("Expected 101, got %v", res.StatusCode)
+	}
+	// the example from RFC 6455 section 1.3
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Bad Sec-WebSocket-Accept %q", accept)
+	}
+	if p := res.Header.Get("Sec-WebSocket-Protocol"); p != "chat" {
+		t.Errorf("Expected subprotocol chat, got %q", p)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	srv := startServer(t, NewFilter(echoHandler))
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"version", "Sec-WebSocket-Version: 8\r\n", 426},
+		{"origin", "Sec-WebSocket-Version: 13\r\nOrigin: http://evil.example.com\r\n", 403},
+	}
+	for _, test := range tests {
+		if _, res := dial(t, srv, test.header); res.StatusCode != test.status {
+			t.Errorf("%v: Expected %v, got %v", test.name, test.status, res.StatusCode)
+		}
+	}
+
+	// plain requests pass through
+	res, err := http.Get(fmt.Sprintf("http://localhost:%v/ws", srv.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("Expected a plain request to pass through, got %v", res.StatusCode)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	srv := startServer(t, NewFilter(echoHandler))
+	c, _ := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+
+	c.writeFrame(0x81, []byte("hello"))
+	if b0, p := c.readFrame(); b0 != 0x81 || string(p) != "hello" {
+		t.Errorf("Expected text hello, got %x %q", b0, p)
+	}
+
+	big := bytes.Repeat([]byte("x"), 1000)
+	c.writeFrame(0x82, big)
+	if b0, p := c.readFrame(); b0 != 0x82 || !bytes.Equal(p, big) {
+		t.Errorf("Expected binary echo, got %x %v bytes", b0, len(p))
+	}
+
+	// fragmented, with a ping in the middle
+	c.writeFrame(0x01, []byte("frag"))
+	c.writeFrame(0x89, []byte("ping"))
+	if b0, p := c.readFrame(); b0 != 0x8a || string(p) != "ping" {
+		t.Errorf("Expected pong, got %x %q", b0, p)
+	}
+	c.writeFrame(0x80, []byte("mented"))
+	if b0, p := c.readFrame(); b0 != 0x81 || string(p) != "fragmented" {
+		t.Errorf("Expected reassembled message, got %x %q", b0, p)
+	}
+
+	// close handshake
+	c.writeFrame(0x88, closePayload(CloseGoingAway, "bye"))
+	b0, p := c.readFrame()
+	if b0 != 0x88 || binary.BigEndian.Uint16(p) != CloseGoingAway {
+		t.Errorf("Expected close 1001 echoed, got %x %v", b0, p)
+	}
+	if _, err := c.br.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(c *testClient)
+		code  int
+	}{
+		{"continuation", func(c *testClient) { c.writeFrame(0x80, []byte("x")) }, CloseProtocolError},
+		{"reserved bits", func(c *testClient) { c.writeFrame(0xc1, []byte("x")) }, CloseProtocolError},
+		{"utf8", func(c *testClient) { c.writeFrame(0x81, []byte{0xff, 0xfe}) }, CloseInvalidPayloadData},
+		{"too big", func(c *testClient) { c.writeFrame(0x82, make([]byte, 200)) }, CloseMessageTooBig},
+		{"unmasked", func(c *testClient) { c.conn.Write([]byte{0x81, 0x01, 'x'}) }, CloseProtocolError},
+		{"fragment overflow", func(c *testClient) {
+			c.writeFrame(0x02, []byte("x"))
+			// a continuation claiming 2^63-1 bytes
+			c.conn.Write([]byte{0x80, 0xff, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		}, CloseMessageTooBig},
+		{"length top bit", func(c *testClient) {
+			c.conn.Write([]byte{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 1})
+		}, CloseProtocolError},
+	}
+	srv := startServer(t, &Filter{Handler: echoHandler, MaxMessageSize: 100})
+	for _, test := range tests {
+		c, _ := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+		test.write(c)
+		b0, p := c.readFrame()
+		if b0 != 0x88 || len(p) < 2 || int(binary.BigEndian.Uint16(p)) != test.code {
+			t.Errorf("%v: Expected close %v, got %x %q", test.name, test.code, b0, p)
+		}
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	done := make(chan error, 1)
+	srv := startServer(t, NewFilter(func(c *Conn) {
+		c.FragmentSize = 4
+		c.WriteMessage(TextMessage, []byte("goodbye"))
+		done <- c.CloseWithStatus(CloseGoingAway, "restarting")
+	}))
+	c, _ := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+
+	var msg []byte
+	for _, want := range []byte{0x01, 0x80} {
+		b0, p := c.readFrame()
+		if b0 != want {
+			t.Errorf("Expected frame %x, got %x", want, b0)
+		}
+		msg = append(msg, p...)
+	}
+	if string(msg) != "goodbye" {
+		t.Errorf("Expected goodbye, got %q", msg)
+	}
+
+	b0, p := c.readFrame()
+	if b0 != 0x88 || binary.BigEndian.Uint16(p) != CloseGoingAway || !strings.HasSuffix(string(p), "restarting") {
+		t.Errorf("Expected close 1001, got %x %q", b0, p)
+	}
+	c.writeFrame(0x88, p[:2])
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Close didn't finish after the close handshake")
+	}
+}
+
+func TestNothingAfterClose(t *testing.T) {
+	srv := startServer(t, NewFilter(func(c *Conn) {
+		go func() {
+			for c.WriteMessage(TextMessage, []byte("spam")) == nil {
+			}
+		}()
+		c.CloseWithStatus(CloseGoingAway, "")
+	}))
+	c, _ := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+	for {
+		b0, p := c.readFrame()
+		if b0 == 0x88 {
+			c.writeFrame(0x88, p[:2])
+			break
+		}
+	}
+	// the server closes the connection next, with no more frames
+	var b [1]byte
+	if n, _ := c.br.Read(b[:]); n != 0 {
+		t.Errorf("Expected nothing after the close frame, got %x", b[0])
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	srv := startServer(t, NewFilter(func(c *Conn) {
+		panic("oops")
+	}))
+	for i := 0; i < 2; i++ {
+		c, res := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+		if res.StatusCode != 101 {
+			t.Fatalf("Expected 101, got %v", res.StatusCode)
+		}
+		var b [1]byte
+		if _, err := c.br.Read(b[:]); err != io.EOF {
+			t.Errorf("Expected the connection to be closed, got %v", err)
+		}
+	}
+}
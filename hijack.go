@@ -0,0 +1,62 @@
+package falcore
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	// Returned by Hijack if the connection has already been taken over
+	ErrHijacked = errors.New("falcore: connection has already been hijacked")
+	// Returned by Hijack if the request didn't come from a connection
+	// that can be taken over, like one built by TestWithRequest or
+	// served through a net/http.ResponseWriter that isn't a Hijacker.
+	ErrNotHijackable = errors.New("falcore: connection can't be hijacked")
+)
+
+// Takes over the request's connection, for HTTP/1.1 Upgrade protocols
+// like WebSockets.  The returned ReadWriter wraps the server's buffers,
+// so it may already hold bytes the client sent after the request.
+//
+// Once hijacked, the server forgets about the connection.  The rest of
+// the pipeline is skipped, no response is written, and the caller is
+// responsible for closing the connection.  Read and write deadlines set
+// by the server's timeouts are cleared.  The RequestCompletionCallback
+// is still called, with a placeholder 101 response.
+func (fReq *Request) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if fReq.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if fReq.hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	c, rw, err := fReq.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	fReq.hijacked = true
+	return c, rw, nil
+}
+
+// Reports whether Hijack has taken over the request's connection
+func (fReq *Request) Hijacked() bool {
+	return fReq.hijacked
+}
+
+// Hands a connection served by handler over to a filter
+func (srv *Server) hijackConn(c net.Conn, bpe *BufferPoolEntry, wbpe *WriteBufferPoolEntry) (net.Conn, *bufio.ReadWriter, error) {
+	srv.untrackConn(c)
+	c.SetDeadline(time.Time{})
+	return c, bufio.NewReadWriter(bpe.Br, wbpe.Br), nil
+}
+
+// Stands in for the response of a hijacked request in the
+// RequestCompletionCallback
+func hijackedResponse(req *http.Request) *http.Response {
+	res := StringResponse(req, 101, nil, "")
+	res.Close = true
+	return res
+}
@@ -0,0 +1,140 @@
+package falcore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Upgrades to a protocol that echoes lines back
+func echoUpgradeFilter(req *Request) *http.Response {
+	if req.HttpRequest.Header.Get("Upgrade") != "echo" {
+		return nil
+	}
+	c, rw, err := req.Hijack()
+	if err != nil {
+		return StringResponse(req.HttpRequest, 500, nil, err.Error())
+	}
+	go func() {
+		defer c.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	}()
+	return nil
+}
+
+func TestHijack(t *testing.T) {
+	var downstreamRan bool
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(echoUpgradeFilter))
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	pipeline.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		downstreamRan = true
+	}))
+	completed := make(chan *http.Response, 1)
+	srv := startTestServer(t, nil, func(srv *Server) {
+		srv.Pipeline = pipeline
+		srv.CompletionCallback = func(req *Request, res *http.Response) {
+			completed <- res
+		}
+		srv.ReadTimeout = 200 * time.Millisecond
+	})
+
+	conn, br := dialServer(t, srv)
+	// the first line arrives along with the request, so it's already
+	// in the server's buffer when the filter hijacks
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhello\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != 101 {
+		t.Fatalf("Expected 101, got %v %v", res, err)
+	}
+	if line, err := br.ReadString('\n'); line != "hello\n" {
+		t.Errorf("Expected buffered line echoed, got %q %v", line, err)
+	}
+
+	// the server's timeouts no longer apply
+	time.Sleep(300 * time.Millisecond)
+	fmt.Fprintf(conn, "world\n")
+	if line, err := br.ReadString('\n'); line != "world\n" {
+		t.Errorf("Expected line echoed, got %q %v", line, err)
+	}
+
+	select {
+	case res := <-completed:
+		if res.StatusCode != 101 {
+			t.Errorf("Expected placeholder 101 in callback, got %v", res.StatusCode)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Completion callback wasn't called")
+	}
+	if downstreamRan {
+		t.Errorf("Downstream shouldn't run for a hijacked request")
+	}
+	if n := srv.Connections(); n != 0 {
+		t.Errorf("Expected hijacked connection to be untracked, got %v", n)
+	}
+
+	// Shutdown doesn't wait for or close hijacked connections
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	fmt.Fprintf(conn, "still here\n")
+	if line, err := br.ReadString('\n'); line != "still here\n" {
+		t.Errorf("Expected line echoed after shutdown, got %q %v", line, err)
+	}
+	conn.Close()
+}
+
+func TestHijackNotHijackable(t *testing.T) {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	req, _ := TestWithRequest(tmp, NewRequestFilter(func(req *Request) *http.Response {
+		if _, _, err := req.Hijack(); err != ErrNotHijackable {
+			t.Errorf("Expected ErrNotHijackable, got %v", err)
+		}
+		return nil
+	}), nil)
+	if req.Hijacked() {
+		t.Errorf("Request shouldn't be hijacked")
+	}
+}
+
+func TestHijackServeHTTP(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(echoUpgradeFilter))
+	hs := httptest.NewServer(NewServer(0, pipeline))
+	defer hs.Close()
+
+	conn, err := net.Dial("tcp", hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != 101 {
+		t.Fatalf("Expected 101, got %v %v", res, err)
+	}
+	fmt.Fprintf(conn, "hello\n")
+	if line, err := br.ReadString('\n'); line != "hello\n" {
+		t.Errorf("Expected line echoed, got %q %v", line, err)
+	}
+}
@@ -0,0 +1,325 @@
+//go:build go1.24
+// +build go1.24
+
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP/2 connections are handed to a net/http.Server, which runs each
+// stream through the Pipeline just like ServeHTTP does.  falcore keeps
+// tracking the connection until the HTTP/2 server is done with it, so
+// connection limits and Shutdown still apply.
+
+// Sent by HTTP/2 clients before anything else
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Largest frame payload a peer must accept before SETTINGS say otherwise
+const http2MaxFrameSize = 16384
+
+type http2Server struct {
+	hs    *http.Server
+	l     *connListener
+	mutex sync.Mutex
+	done  map[net.Conn]chan struct{}
+}
+
+type http2ConnKey struct{}
+
+// The server's HTTP/2 server, started on first use
+func (srv *Server) http2() *http2Server {
+	srv.h2Once.Do(func() {
+		h2 := &http2Server{
+			l:    newConnListener(),
+			done: make(map[net.Conn]chan struct{}),
+		}
+		h2.hs = &http.Server{
+			Handler: http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+				c, _ := req.Context().Value(http2ConnKey{}).(net.Conn)
+				srv.serveHTTP(wr, req, c)
+			}),
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, http2ConnKey{}, c)
+			},
+			ConnState:         h2.connState,
+			ReadHeaderTimeout: srv.ReadHeaderTimeout,
+			ReadTimeout:       srv.ReadTimeout,
+			WriteTimeout:      srv.WriteTimeout,
+			IdleTimeout:       srv.IdleTimeout,
+			MaxHeaderBytes:    srv.MaxHeaderBytes,
+			ErrorLog:          log.New(errorLogWriter{srv}, "", 0),
+		}
+		h2.hs.Protocols = new(http.Protocols)
+		h2.hs.Protocols.SetHTTP2(true)
+		h2.hs.Protocols.SetUnencryptedHTTP2(true)
+		go h2.hs.Serve(h2.l)
+		// GOAWAY all HTTP/2 connections once the server stops
+		go func() {
+			<-srv.stopAccepting
+			h2.hs.Shutdown(context.Background())
+		}()
+		srv.h2 = h2
+	})
+	return srv.h2
+}
+
+// Serves HTTP/2 on c until the client or the server is done with it.
+// h2c is what the HTTP/2 server reads from and writes to.  It is c,
+// or c with data the server has already read put back in front.
+func (srv *Server) serveHTTP2(c, h2c net.Conn) {
+	h2 := srv.http2()
+	done := make(chan struct{})
+	h2.mutex.Lock()
+	h2.done[h2c] = done
+	h2.mutex.Unlock()
+
+	srv.setConnState(c, connStateHTTP2)
+	if !h2.l.push(h2c) {
+		// shutting down
+		h2.mutex.Lock()
+		delete(h2.done, h2c)
+		h2.mutex.Unlock()
+		return
+	}
+	<-done
+}
+
+func (h2 *http2Server) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	h2.mutex.Lock()
+	if done, ok := h2.done[c]; ok {
+		close(done)
+		delete(h2.done, c)
+	}
+	h2.mutex.Unlock()
+}
+
+// ALPN protocols offered by ListenAndServeTLS
+func (srv *Server) tlsNextProtos() []string {
+	if srv.EnableHTTP2 {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
+
+// Serves HTTP/2 if c is a TLS connection that negotiated h2.  Reports
+// whether it did.
+func (srv *Server) serveNegotiatedHTTP2(c net.Conn) bool {
+	tc, ok := c.(*tls.Conn)
+	if !ok || !srv.EnableHTTP2 {
+		return false
+	}
+	srv.setReadDeadline(c, time.Now(), srv.readHeaderTimeout())
+	if err := tc.Handshake(); err != nil {
+		// reading the first request reports the error
+		return false
+	}
+	if tc.ConnectionState().NegotiatedProtocol != "h2" {
+		return false
+	}
+	srv.serveHTTP2(c, c)
+	return true
+}
+
+// Reports whether the client is starting HTTP/2 with prior knowledge
+func (srv *Server) isH2CPreface(br *bufio.Reader) bool {
+	if !srv.EnableH2C {
+		return false
+	}
+	// A shorter peek first, so short HTTP/1 requests don't block
+	if b, err := br.Peek(len("PRI * HTTP/2.0")); err != nil || string(b) != http2Preface[:len(b)] {
+		return false
+	}
+	b, err := br.Peek(len(http2Preface))
+	return err == nil && string(b) == http2Preface
+}
+
+// Handles an HTTP/1.1 request asking to upgrade to h2c.  If the
+// upgrade is accepted, it returns the connection to serve HTTP/2 on,
+// with the request waiting on it as stream 1.  upgraded reports whether
+// a 101 was sent; h2c is nil if the upgrade failed after that.
+//
+// net/http has no way to hand it an upgraded connection, so the HTTP/2
+// server is shown what a client with prior knowledge would have sent:
+// the settings from the HTTP2-Settings header go in front of those in
+// the client's first SETTINGS frame, which can override them, and the
+// request follows as a HEADERS frame.
+//
+// Requests with a body are served over HTTP/1.1 instead.
+func (srv *Server) upgradeH2C(c net.Conn, req *http.Request, br *bufio.Reader, bw *bufio.Writer) (h2c net.Conn, upgraded bool) {
+	if !srv.EnableH2C || !HeaderHasToken(req.Header, "Upgrade", "h2c") ||
+		!HeaderHasToken(req.Header, "Connection", "upgrade") ||
+		!HeaderHasToken(req.Header, "Connection", "http2-settings") ||
+		len(req.Header["Http2-Settings"]) != 1 ||
+		req.ContentLength != 0 || len(req.TransferEncoding) > 0 {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Header.Get("Http2-Settings"), "="))
+	if err != nil || len(settings)%6 != 0 || len(settings) > http2MaxFrameSize {
+		// each setting is 6 bytes
+		return nil, false
+	}
+	headers := http2RequestHeaders(req)
+	if headers == nil {
+		return nil, false
+	}
+
+	bw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err := bw.Flush(); err != nil {
+		return nil, true
+	}
+
+	// The client now sends the preface and its SETTINGS.  The request
+	// goes in right after them, as if the client had sent it as
+	// stream 1.
+	srv.setReadDeadline(c, time.Now(), srv.readHeaderTimeout())
+	start := make([]byte, len(http2Preface)+9)
+	if _, err := io.ReadFull(br, start); err != nil || string(start[:len(http2Preface)]) != http2Preface {
+		return nil, true
+	}
+	frame := start[len(http2Preface):]
+	length := int(frame[0])<<16 | int(frame[1])<<8 | int(frame[2])
+	if frame[3] != 0x4 || frame[4]&0x1 != 0 || length+len(settings) > http2MaxFrameSize { // SETTINGS, not ACK
+		return nil, true
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, true
+	}
+	length += len(settings)
+	frame[0], frame[1], frame[2] = byte(length>>16), byte(length>>8), byte(length)
+
+	var buf bytes.Buffer
+	buf.Write(start)
+	buf.Write(settings)
+	buf.Write(payload)
+	buf.Write(headers)
+	return &bufferedConn{c, io.MultiReader(&buf, br)}, true
+}
+
+// Encodes req as an HTTP/2 HEADERS frame for stream 1 with no body.
+// Returns nil if the headers don't fit in one frame.
+func http2RequestHeaders(req *http.Request) []byte {
+	var block []byte
+	field := func(name, value string) {
+		// literal header field without indexing, new name
+		block = append(block, 0)
+		block = hpackString(block, name)
+		block = hpackString(block, value)
+	}
+	field(":method", req.Method)
+	field(":scheme", "http")
+	field(":authority", req.Host)
+	field(":path", req.URL.RequestURI())
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		switch lower {
+		case "connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection",
+			"transfer-encoding", "host", "te":
+			continue
+		}
+		for _, v := range values {
+			field(lower, v)
+		}
+	}
+	if len(block) > http2MaxFrameSize {
+		return nil
+	}
+
+	frame := make([]byte, 9, 9+len(block))
+	frame[0] = byte(len(block) >> 16)
+	frame[1] = byte(len(block) >> 8)
+	frame[2] = byte(len(block))
+	frame[3] = 0x1       // HEADERS
+	frame[4] = 0x1 | 0x4 // END_STREAM | END_HEADERS
+	binary.BigEndian.PutUint32(frame[5:], 1)
+	return append(frame, block...)
+}
+
+// Appends s as an HPACK string literal without Huffman coding
+func hpackString(b []byte, s string) []byte {
+	// integer with a 7 bit prefix
+	n := len(s)
+	if n < 127 {
+		b = append(b, byte(n))
+	} else {
+		b = append(b, 127)
+		for n -= 127; n >= 128; n >>= 7 {
+			b = append(b, byte(n&0x7f|0x80))
+		}
+		b = append(b, byte(n))
+	}
+	return append(b, s...)
+}
+
+// Hands accepted connections to a net/http.Server
+type connListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Passes c to Accept.  Returns false if the listener is closed.
+func (l *connListener) push(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return connListenerAddr{}
+}
+
+type connListenerAddr struct{}
+
+func (connListenerAddr) Network() string { return "falcore" }
+func (connListenerAddr) String() string  { return "falcore" }
+
+// Sends the HTTP/2 server's log output to the falcore logger
+type errorLogWriter struct {
+	srv *Server
+}
+
+func (w errorLogWriter) Write(p []byte) (int, error) {
+	Error("%s %s", w.srv.serverLogPrefix(), bytes.TrimRight(p, "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,33 @@
+//go:build !go1.24
+// +build !go1.24
+
+package falcore
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// HTTP/2 needs net/http.Protocols from Go 1.24.  Before that,
+// EnableHTTP2 and EnableH2C are ignored.
+
+type http2Server struct{}
+
+func (srv *Server) tlsNextProtos() []string {
+	return []string{"http/1.1"}
+}
+
+func (srv *Server) serveNegotiatedHTTP2(c net.Conn) bool {
+	return false
+}
+
+func (srv *Server) isH2CPreface(br *bufio.Reader) bool {
+	return false
+}
+
+func (srv *Server) upgradeH2C(c net.Conn, req *http.Request, br *bufio.Reader, bw *bufio.Writer) (net.Conn, bool) {
+	return nil, false
+}
+
+func (srv *Server) serveHTTP2(c, h2c net.Conn) {}
@@ -0,0 +1,215 @@
+//go:build go1.24
+// +build go1.24
+
+package falcore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startHTTP2Server(t *testing.T, tlsConfig *tls.Config) *Server {
+	filter := NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, req.HttpRequest.Proto+" "+req.HttpRequest.URL.Path)
+	})
+	return startTestServer(t, filter, func(srv *Server) {
+		srv.EnableHTTP2 = true
+		srv.EnableH2C = true
+		srv.TLSConfig = tlsConfig
+	})
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Couldn't get %v: %v", url, err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res, string(body)
+}
+
+func TestHTTP2TLS(t *testing.T) {
+	srv := startHTTP2Server(t, testTLSConfig(t))
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	for i := 0; i < 2; i++ {
+		res, body := getBody(t, client, fmt.Sprintf("https://localhost:%v/h2", srv.Port()))
+		if res.Proto != "HTTP/2.0" || body != "HTTP/2.0 /h2" {
+			t.Errorf("Expected an HTTP/2 response, got %v %q", res.Proto, body)
+		}
+	}
+
+	// clients without h2 still get HTTP/1.1
+	client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	res, body := getBody(t, client, fmt.Sprintf("https://localhost:%v/h1", srv.Port()))
+	if res.Proto != "HTTP/1.1" || body != "HTTP/1.1 /h1" {
+		t.Errorf("Expected an HTTP/1.1 response, got %v %q", res.Proto, body)
+	}
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	srv := startHTTP2Server(t, nil)
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	res, body := getBody(t, &http.Client{Transport: tr}, fmt.Sprintf("http://localhost:%v/h2c", srv.Port()))
+	if res.Proto != "HTTP/2.0" || body != "HTTP/2.0 /h2c" {
+		t.Errorf("Expected an HTTP/2 response, got %v %q", res.Proto, body)
+	}
+
+	// and HTTP/1.1 on the same port
+	res, body = getBody(t, http.DefaultClient, fmt.Sprintf("http://localhost:%v/h1", srv.Port()))
+	if res.Proto != "HTTP/1.1" || body != "HTTP/1.1 /h1" {
+		t.Errorf("Expected an HTTP/1.1 response, got %v %q", res.Proto, body)
+	}
+}
+
+func TestHTTP2Upgrade(t *testing.T) {
+	srv := startHTTP2Server(t, nil)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /upgraded HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAAAF\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Couldn't read upgrade response: %v", err)
+	}
+	if res.StatusCode != 101 || res.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("Expected 101 to h2c, got %v %v", res.StatusCode, res.Header)
+	}
+
+	// preface and an empty SETTINGS frame
+	conn.Write([]byte(http2Preface + "\x00\x00\x00\x04\x00\x00\x00\x00\x00"))
+
+	// The response to the upgrade request comes back on stream 1.  The
+	// header set a 5 byte window, so that's all it gets until it's
+	// opened up.
+	var body []byte
+	updated := false
+	for {
+		var h [9]byte
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			t.Fatalf("Couldn't read frame: %v", err)
+		}
+		payload := make([]byte, int(h[0])<<16|int(h[1])<<8|int(h[2]))
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatalf("Couldn't read frame: %v", err)
+		}
+		if stream := binary.BigEndian.Uint32(h[5:]) & 0x7fffffff; stream != 1 {
+			continue
+		}
+		if h[3] == 0x0 { // DATA
+			body = append(body, payload...)
+			if len(body) > 5 && !updated {
+				t.Fatalf("Expected the HTTP2-Settings window of 5 bytes, got %q", body)
+			}
+			if len(body) == 5 && !updated {
+				// WINDOW_UPDATE stream 1 by 100
+				conn.Write([]byte("\x00\x00\x04\x08\x00\x00\x00\x00\x01\x00\x00\x00\x64"))
+				updated = true
+			}
+		}
+		if h[4]&0x1 != 0 { // END_STREAM
+			break
+		}
+	}
+	if string(body) != "HTTP/2.0 /upgraded" {
+		t.Errorf("Expected the upgraded request's response, got %q", body)
+	}
+}
+
+func TestHTTP2Shutdown(t *testing.T) {
+	srv := startHTTP2Server(t, nil)
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	getBody(t, &http.Client{Transport: tr}, fmt.Sprintf("http://localhost:%v/", srv.Port()))
+
+	// the idle HTTP/2 connection mustn't hold up shutdown
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Shutdown didn't finish with an HTTP/2 connection open")
+	}
+	tr.CloseIdleConnections()
+}
+
+// PROXY headers and what they carry reach requests over HTTP/2 too
+func TestHTTP2ProxyProtocol(t *testing.T) {
+	nets, _ := ParseCIDRs("127.0.0.1")
+	srv := startTestServer(t, NewRequestFilter(func(req *Request) *http.Response {
+		authority := ""
+		if h := req.ProxyHeader(); h != nil {
+			authority = h.Authority()
+		}
+		return StringResponse(req.HttpRequest, 200, nil, req.ClientIP.String()+" "+authority)
+	}), func(srv *Server) {
+		srv.EnableHTTP2 = true
+		srv.ProxyProtocolNetworks = nets
+		srv.TLSConfig = testTLSConfig(t)
+	})
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			if err == nil {
+				// the header comes before the handshake
+				c.Write(proxyV2Header(proxyTLV(ProxyTLVAuthority, "example.com")))
+			}
+			return c, err
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	res, body := getBody(t, client, fmt.Sprintf("https://127.0.0.1:%v/", srv.Port()))
+	if res.Proto != "HTTP/2.0" || body != "192.0.2.1 example.com" {
+		t.Errorf("Expected the proxied client over HTTP/2, got %v %q", res.Proto, body)
+	}
+}
+
+func TestHTTP2MaxBodyBytes(t *testing.T) {
+	srv := startTestServer(t, bodySizeFilter, func(srv *Server) {
+		srv.EnableH2C = true
+		srv.Pipeline.MaxBodyBytes = 10
+	})
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	// no Content-Length, so the limit is only hit while reading
+	body := io.MultiReader(strings.NewReader("hello "), strings.NewReader("world"))
+	res, err := (&http.Client{Transport: tr}).Post(fmt.Sprintf("http://localhost:%v/", srv.Port()), "text/plain", body)
+	if err != nil {
+		t.Fatalf("Couldn't post: %v", err)
+	}
+	res.Body.Close()
+	if res.Proto != "HTTP/2.0" || res.StatusCode != 413 {
+		t.Errorf("Expected an HTTP/2 413, got %v %v", res.Proto, res.StatusCode)
+	}
+}
@@ -0,0 +1,152 @@
+package falcore
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var okFilter = NewRequestFilter(func(req *Request) *http.Response {
+	return StringResponse(req.HttpRequest, 200, nil, "OK")
+})
+
+// Makes a request on a new connection and returns the status code
+func requestOnNewConn(t *testing.T, srv *Server) int {
+	conn, br := dialServer(t, srv)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestMaxConnectionsReject(t *testing.T) {
+	srv := startTestServer(t, okFilter, func(srv *Server) {
+		srv.MaxConnections = 1
+		srv.RejectOverLimit = true
+	})
+
+	if status := requestOnNewConn(t, srv); status != 200 {
+		t.Fatalf("Expected 200 for the first connection, got %v", status)
+	}
+	// The first connection is still open
+	if status := requestOnNewConn(t, srv); status != 503 {
+		t.Errorf("Expected 503 over the limit, got %v", status)
+	}
+	if n := srv.Connections(); n != 1 {
+		t.Errorf("Expected 1 open connection, got %v", n)
+	}
+	if n := srv.PeakConnections(); n != 1 {
+		t.Errorf("Expected a peak of 1 connection, got %v", n)
+	}
+}
+
+func TestMaxConnectionsStopAccepting(t *testing.T) {
+	srv := startTestServer(t, okFilter, func(srv *Server) {
+		srv.MaxConnections = 1
+	})
+
+	first, br := dialServer(t, srv)
+	fmt.Fprintf(first, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if res, err := http.ReadResponse(br, nil); err != nil || res.StatusCode != 200 {
+		t.Fatalf("First request failed: %v %v", res, err)
+	}
+
+	// The second connection waits in the backlog until the first closes
+	status := make(chan int, 1)
+	go func() {
+		status <- requestOnNewConn(t, srv)
+	}()
+	select {
+	case s := <-status:
+		t.Fatalf("Second connection was served while over the limit: %v", s)
+	case <-time.After(200 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case s := <-status:
+		if s != 200 {
+			t.Errorf("Expected 200 once under the limit, got %v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Second connection was never served")
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	srv := startTestServer(t, okFilter, func(srv *Server) {
+		srv.MaxConnectionsPerIP = 2
+	})
+
+	for i := 0; i < 2; i++ {
+		if status := requestOnNewConn(t, srv); status != 200 {
+			t.Fatalf("Expected 200 under the limit, got %v", status)
+		}
+	}
+	if status := requestOnNewConn(t, srv); status != 503 {
+		t.Errorf("Expected 503 over the per-IP limit, got %v", status)
+	}
+}
+
+func TestMaxConnectionsSeveralListeners(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	srv.Pipeline.Upstream.PushBack(okFilter)
+	srv.MaxConnections = 1
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		go srv.Serve(l)
+	}
+	t.Cleanup(srv.StopAccepting)
+	<-srv.AcceptReady
+
+	request := func(addr string) (net.Conn, int) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Errorf("Couldn't connect: %v", err)
+			return nil, 0
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Errorf("Couldn't read response: %v", err)
+			return conn, 0
+		}
+		res.Body.Close()
+		return conn, res.StatusCode
+	}
+	first, status := request(addrs[0])
+	if status != 200 {
+		t.Fatalf("Expected 200 for the first connection, got %v", status)
+	}
+
+	// Both accept loops are waiting for the slot.  Only one may take it
+	// when it frees up; the other connection waits its turn.
+	statuses := make(chan int, 2)
+	for _, addr := range addrs {
+		go func(addr string) {
+			conn, status := request(addr)
+			statuses <- status
+			if conn != nil {
+				conn.Close()
+			}
+		}(addr)
+	}
+	time.Sleep(100 * time.Millisecond)
+	first.Close()
+	for i := 0; i < 2; i++ {
+		if status := <-statuses; status != 200 {
+			t.Errorf("Expected 200, got %v", status)
+		}
+	}
+}
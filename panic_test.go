@@ -1,30 +1,154 @@
 package falcore
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestFilterPanic(t *testing.T) {
-	pipeline := NewPipeline()
-	pipeline.Upstream.PushBack(NewRequestFilter(func(*Request) *http.Response { panic("this isn't supposed to happen") }))
-	srv := NewServer(0, pipeline)
-	defer srv.StopAccepting()
-	go func() {
-		srv.ListenAndServe()
-	}()
-	<-srv.AcceptReady
+	type finished struct {
+		path      string
+		failed    []string
+		signature string
+	}
+	done := make(chan finished, 2)
+	caught := make(chan interface{}, 1)
+	srv := startTestServer(t, NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/panic" {
+			panic("this isn't supposed to happen")
+		}
+		return StringResponse(req.HttpRequest, 200, nil, "ok")
+	}), func(srv *Server) {
+		srv.Pipeline.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+			res.Header.Set("X-Downstream", "yes")
+		}))
+		srv.CompletionCallback = func(req *Request, res *http.Response) {
+			f := finished{path: req.HttpRequest.URL.Path}
+			for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+				if pss := e.Value.(*PipelineStageStat); pss.Status == 2 {
+					f.failed = append(f.failed, pss.Name)
+				}
+			}
+			f.signature = req.Signature()
+			done <- f
+		}
+		srv.PanicHandler = func(c net.Conn, err interface{}) {
+			caught <- err
+		}
+	})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", srv.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	// the connection is still good after the panic
+	for _, test := range []struct {
+		path   string
+		status int
+	}{{"/panic", 500}, {"/", 200}} {
+		fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: localhost\r\n\r\n", test.path)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%v: Couldn't read response: %v", test.path, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.status || res.Header.Get("X-Downstream") != "yes" {
+			t.Errorf("%v: Expected %v through the Downstream, got %v %v", test.path, test.status, res.StatusCode, res.Header)
+		}
+	}
+
+	// the callbacks can run in either order
+	results := make(map[string]finished)
+	for i := 0; i < 2; i++ {
+		f := <-done
+		results[f.path] = f
+	}
+	panicked, ok := results["/panic"], results["/"]
+	if len(panicked.failed) != 1 || panicked.failed[0] != "*falcore.genericRequestFilter" {
+		t.Errorf("Expected the panicking stage to be marked as failed, got %v", panicked.failed)
+	}
+	if len(ok.failed) != 0 || panicked.signature == ok.signature {
+		t.Errorf("Expected the failed request to have its own signature, got %v and %v", panicked.signature, ok.signature)
+	}
+	select {
+	case err := <-caught:
+		t.Errorf("Expected the pipeline to recover, not the PanicHandler: %v", err)
+	default:
+	}
+}
 
-	var caught bool
-	srv.PanicHandler = func(c net.Conn, err interface{}) {
-		if c != nil && err != nil {
-			caught = true
+func TestPanicResponse(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response { panic(fmt.Errorf("boom")) }))
+	inner.PanicResponse = func(req *Request, err interface{}) *http.Response {
+		return StringResponse(req.HttpRequest, 503, nil, fmt.Sprint(err))
+	}
+	router := NewRouter(func(req *Request) RequestFilter {
+		if req.HttpRequest.URL.Path == "/router" {
+			panic("router")
+		}
+		return inner
+	})
+	outer := NewPipeline()
+	outer.Upstream.PushBack(router)
+	outer.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		panic("downstream")
+	}))
+	outer.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Downstream", "yes")
+	}))
+
+	for _, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{{"/", 503, "boom"}, {"/router", 500, "Internal Server Error\n"}} {
+		tmp, _ := http.NewRequest("GET", test.path, nil)
+		_, res := TestWithRequest(tmp, outer, nil)
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != test.status || string(body) != test.body {
+			t.Errorf("%v: Expected %v %q, got %v %q", test.path, test.status, test.body, res.StatusCode, body)
+		}
+		if res.Header.Get("X-Downstream") != "yes" {
+			t.Errorf("%v: Expected the Downstream to continue after a panic", test.path)
 		}
 	}
+}
+
+type panicBody struct{}
+
+func (panicBody) Read([]byte) (int, error) { panic("body") }
+func (panicBody) Close() error             { return nil }
+
+func TestPanicHandler(t *testing.T) {
+	caught := make(chan interface{}, 1)
+	srv := startTestServer(t, NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, -1, panicBody{})
+	}), func(srv *Server) {
+		srv.PanicHandler = func(c net.Conn, err interface{}) {
+			if c != nil {
+				caught <- err
+			}
+		}
+	})
+
+	// panics outside the pipeline still reach the PanicHandler
 	http.Get(fmt.Sprintf("http://localhost:%d", srv.Port()))
-	if !caught {
+	select {
+	case err := <-caught:
+		if err != "body" {
+			t.Errorf("Unexpected panic %v", err)
+		}
+	case <-time.After(5 * time.Second):
 		t.Fatal("panic handler was not called")
 	}
 }
@@ -2,9 +2,11 @@ package falcore
 
 import (
 	"container/list"
+	"errors"
 	"log"
 	"net/http"
 	"reflect"
+	"runtime/debug"
 )
 
 // Pipelines have an Upstream and Downstream list of filters.
@@ -14,14 +16,46 @@ import (
 // is ended, and FilterResponse is called for ALL ResponseFilters
 // in the Downstream list, in order.
 //
-// If no Response is returned from any of the Upstream filters,
-// then execution of the Downstream is skipped and the server
-// will return a default 404 response.
+// If no Response is returned from any of the Upstream filters, the
+// server answers with a 404 from the ErrorHandler, which goes through
+// the Downstream of the server's Pipeline.  Nested Pipelines return
+// nil instead, so the Pipeline they're in can carry on.
+//
+// If a filter hijacks the connection, the rest of the pipeline,
+// Downstream included, is skipped.
+//
+// Responses with a Trailer are sent chunked, with the trailers after
+// the body.  Their values may be filled in until the body returns EOF.
 //
 // The Upstream list may also contain instances of Router.
+//
+// A filter or router that panics is marked as failed (Status 2) in
+// the PipelineStageStats and the stack is logged with the request ID.
+// A panic in the Upstream is answered with PanicResponse, which then
+// goes through the Downstream like any other response.  A panic in a
+// Downstream filter leaves the response as it was and the remaining
+// Downstream filters still run.  The connection stays open either way.
+//
+// Filters implementing RequestFilterErr can return an error instead
+// of a response.  ErrorHandler turns it into the response, which goes
+// through the Downstream as usual.  A nested Pipeline without an
+// ErrorHandler uses the one of the Pipeline it runs in, and the
+// outermost defaults to ErrorResponse.
+//
+// If MaxBodyBytes is set, requests with larger bodies get a 413 and
+// the connection is closed.  A Content-Length over the limit is
+// rejected before any filters run.  Otherwise reading past the limit
+// returns ErrBodyTooLarge.  When pipelines are nested, the smallest
+// limit applies.
 type Pipeline struct {
-	Upstream   *list.List
-	Downstream *list.List
+	Upstream     *list.List
+	Downstream   *list.List
+	MaxBodyBytes int64
+	// Makes the response for a panic in the Upstream.  err is the value
+	// passed to panic.  Defaults to a 500 from the ErrorHandler.
+	PanicResponse func(req *Request, err interface{}) *http.Response
+	// Makes the response for an error returned by a RequestFilterErr
+	ErrorHandler func(req *Request, err error) *http.Response
 }
 
 func NewPipeline() (l *Pipeline) {
@@ -37,13 +71,20 @@ func (p *Pipeline) FilterRequest(req *Request) *http.Response {
 }
 
 func (p *Pipeline) execute(req *Request) (res *http.Response) {
-	for e := p.Upstream.Front(); e != nil && res == nil; e = e.Next() {
+	if p.ErrorHandler != nil {
+		outer := req.errorHandler
+		req.errorHandler = p.ErrorHandler
+		defer func() { req.errorHandler = outer }()
+	}
+	res = req.limitBody(p.MaxBodyBytes)
+	for e := p.Upstream.Front(); e != nil && res == nil && !req.hijacked; e = e.Next() {
 		switch filter := e.Value.(type) {
 		case Router:
 			t := reflect.TypeOf(filter)
 			req.startPipelineStage(t.String())
 			req.CurrentStage.Type = PipelineStageTypeRouter
-			pipe := filter.SelectPipeline(req)
+			var pipe RequestFilter
+			pipe, res = p.selectPipeline(req, filter)
 			req.finishPipelineStage()
 			if pipe != nil {
 				res = p.execFilter(req, pipe)
@@ -62,34 +103,127 @@ func (p *Pipeline) execute(req *Request) (res *http.Response) {
 		}
 	}
 
-	if res != nil {
+	if res != nil && !req.hijacked {
 		p.down(req, res)
 	}
 
 	return
 }
 
-func (p *Pipeline) execFilter(req *Request, filter RequestFilter) *http.Response {
+func (p *Pipeline) execFilter(req *Request, filter RequestFilter) (res *http.Response) {
+	if c, ok := filter.(*conditionalFilter); ok {
+		if run, res := p.checkCondition(req, c.pred, nil, c.filter, PipelineStageTypeUpstream); !run {
+			return res
+		}
+		return p.execFilter(req, c.filter)
+	}
 	if _, skipTracking := filter.(*Pipeline); !skipTracking {
 		t := reflect.TypeOf(filter)
 		req.startPipelineStage(t.String())
 		req.CurrentStage.Type = PipelineStageTypeUpstream
 		defer req.finishPipelineStage()
+		defer func() {
+			if err := recover(); err != nil {
+				res = p.recovered(req, err)
+			}
+		}()
+	}
+	if ef, ok := filter.(RequestFilterErr); ok {
+		res, err := ef.FilterRequestErr(req)
+		if err != nil {
+			if res != nil && res.Body != nil {
+				res.Body.Close()
+			}
+			return p.failed(req, err)
+		}
+		return res
 	}
 	return filter.FilterRequest(req)
 }
 
+// The response when no Upstream filter answered the request
+func (p *Pipeline) notFound(req *Request) *http.Response {
+	var res *http.Response
+	if p.ErrorHandler != nil {
+		res = p.ErrorHandler(req, &HTTPError{Status: 404})
+	} else {
+		res = ErrorResponse(req, &HTTPError{Status: 404})
+	}
+	p.down(req, res)
+	return res
+}
+
+// Marks the current stage as failed and renders err
+func (p *Pipeline) failed(req *Request, err error) *http.Response {
+	req.CurrentStage.Status = 2
+	var he *HTTPError
+	if errors.As(err, &he) {
+		Debug("%s %s failed: %v", req.ID, req.CurrentStage.Name, err)
+	} else {
+		// nobody has said what went wrong yet
+		Error("%s %s failed: %v", req.ID, req.CurrentStage.Name, err)
+	}
+	return p.errorResponse(req, err)
+}
+
+func (p *Pipeline) errorResponse(req *Request, err error) *http.Response {
+	if req.errorHandler != nil {
+		return req.errorHandler(req, err)
+	}
+	return ErrorResponse(req, err)
+}
+
+func (p *Pipeline) selectPipeline(req *Request, router Router) (pipe RequestFilter, res *http.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			pipe, res = nil, p.recovered(req, err)
+		}
+	}()
+	return router.SelectPipeline(req), nil
+}
+
+func (p *Pipeline) filterResponse(req *Request, filter ResponseFilter, res *http.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			p.recovered(req, err)
+		}
+	}()
+	filter.FilterResponse(req, res)
+}
+
+// Marks the current stage as failed, logs the panic and returns the
+// response to send instead
+func (p *Pipeline) recovered(req *Request, err interface{}) *http.Response {
+	req.CurrentStage.Status = 2
+	Error("%s PANIC in %s: %v\n%s", req.ID, req.CurrentStage.Name, err, debug.Stack())
+	if p.PanicResponse != nil {
+		return p.PanicResponse(req, err)
+	}
+	return p.errorResponse(req, &HTTPError{Status: 500})
+}
+
 func (p *Pipeline) down(req *Request, res *http.Response) {
 	for e := p.Downstream.Front(); e != nil; e = e.Next() {
 		if filter, ok := e.Value.(ResponseFilter); ok {
-			t := reflect.TypeOf(filter)
-			req.startPipelineStage(t.String())
-			req.CurrentStage.Type = PipelineStageTypeDownstream
-			filter.FilterResponse(req, res)
-			req.finishPipelineStage()
+			p.execResponseFilter(req, filter, res)
 		} else {
 			// TODO
 			break
 		}
 	}
 }
+
+func (p *Pipeline) execResponseFilter(req *Request, filter ResponseFilter, res *http.Response) {
+	if c, ok := filter.(*conditionalResponseFilter); ok {
+		if run, _ := p.checkCondition(req, c.pred, res, c.filter, PipelineStageTypeDownstream); !run {
+			return
+		}
+		p.execResponseFilter(req, c.filter, res)
+		return
+	}
+	t := reflect.TypeOf(filter)
+	req.startPipelineStage(t.String())
+	req.CurrentStage.Type = PipelineStageTypeDownstream
+	p.filterResponse(req, filter, res)
+	req.finishPipelineStage()
+}
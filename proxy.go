@@ -0,0 +1,286 @@
+package falcore
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What a load balancer passed along in a PROXY protocol header.  See
+// Server.ProxyProtocolNetworks.
+type ProxyHeader struct {
+	// 1 or 2
+	Version int
+	// The balancer opened the connection for itself, for example for a
+	// health check.  The addresses are not set and the connection's own
+	// address is used.
+	Local bool
+	// The client's address and the address it connected to
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+	// Version 2 type-length-value fields, by type.  See the ProxyTLV
+	// constants.
+	TLVs map[byte][]byte
+}
+
+// PROXY protocol v2 TLV types
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+// The host name the client asked the balancer for, usually the TLS SNI
+// when the balancer terminates TLS.  Empty if it wasn't sent.
+func (h *ProxyHeader) Authority() string {
+	return string(h.TLVs[ProxyTLVAuthority])
+}
+
+// The application protocol the client negotiated with the balancer.
+// Empty if it wasn't sent.
+func (h *ProxyHeader) ALPN() string {
+	return string(h.TLVs[ProxyTLVALPN])
+}
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errProxyHeader = errors.New("falcore: bad PROXY protocol header")
+)
+
+// The longest v1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+// Parses networks for Server.ProxyProtocolNetworks.  Each is in CIDR
+// notation, like "10.0.0.0/8", or a single IP address.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("falcore: bad IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Wraps connections from trusted balancers so their PROXY header can
+// be read
+type proxyListener struct {
+	net.Listener
+	networks []*net.IPNet
+}
+
+func (srv *Server) proxyListener(l net.Listener) net.Listener {
+	if len(srv.ProxyProtocolNetworks) == 0 {
+		return l
+	}
+	return &proxyListener{l, srv.ProxyProtocolNetworks}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		for _, n := range l.networks {
+			if n.Contains(addr.IP) {
+				return &proxyConn{Conn: c}, nil
+			}
+		}
+	}
+	return c, nil
+}
+
+// A connection that starts with a PROXY header.  The handler reads the
+// header before anything else; RemoteAddr then reports the client.
+type proxyConn struct {
+	net.Conn
+	header *ProxyHeader
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.header != nil && c.header.SourceAddr != nil {
+		return c.header.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// The proxyConn underneath c, if any
+func asProxyConn(c net.Conn) *proxyConn {
+	for {
+		switch t := c.(type) {
+		case *proxyConn:
+			return t
+		case *tls.Conn:
+			c = t.NetConn()
+		case *bufferedConn:
+			c = t.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// The address of the peer c is connected to, which is the balancer for
+// connections that start with a PROXY header
+func directRemoteAddr(c net.Conn) net.Addr {
+	if pc := asProxyConn(c); pc != nil {
+		return pc.Conn.RemoteAddr()
+	}
+	return c.RemoteAddr()
+}
+
+// Reads the PROXY header from connections that should have one
+func (srv *Server) readProxyHeader(c net.Conn) error {
+	pc := asProxyConn(c)
+	if pc == nil {
+		return nil
+	}
+	srv.setReadDeadline(c, time.Now(), srv.readHeaderTimeout())
+	h, err := parseProxyHeader(pc.Conn)
+	if err != nil {
+		return err
+	}
+	pc.header = h
+	return nil
+}
+
+// Reads a v1 or v2 header from r, without reading past it
+func parseProxyHeader(r io.Reader) (*ProxyHeader, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(r, b[:len(proxyV1Prefix)]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b[:len(proxyV1Prefix)], proxyV1Prefix) {
+		return parseProxyV1(r)
+	}
+	if _, err := io.ReadFull(r, b[len(proxyV1Prefix):]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b[:len(proxyV2Sig)], proxyV2Sig) {
+		return parseProxyV2(r, b[12], b[13], binary.BigEndian.Uint16(b[14:]))
+	}
+	return nil, errProxyHeader
+}
+
+// Parses the rest of "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func parseProxyV1(r io.Reader) (*ProxyHeader, error) {
+	// one byte at a time so the request after the header stays unread
+	line := make([]byte, 0, proxyV1MaxLength)
+	var c [1]byte
+	for {
+		if _, err := io.ReadFull(r, c[:]); err != nil {
+			return nil, err
+		}
+		if c[0] == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLength-len(proxyV1Prefix)-1 {
+			return nil, errProxyHeader
+		}
+		line = append(line, c[0])
+	}
+	if len(line) == 0 || line[len(line)-1] != '\r' {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-1]), " ")
+	h := &ProxyHeader{Version: 1}
+	switch {
+	case fields[0] == "UNKNOWN":
+		h.Local = true
+		return h, nil
+	case len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6"):
+		return nil, errProxyHeader
+	}
+	src, dst := net.ParseIP(fields[1]), net.ParseIP(fields[2])
+	srcPort, err1 := strconv.ParseUint(fields[3], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[4], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, errProxyHeader
+	}
+	h.SourceAddr = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	h.DestAddr = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return h, nil
+}
+
+func parseProxyV2(r io.Reader, verCmd, family byte, length uint16) (*ProxyHeader, error) {
+	if verCmd>>4 != 2 || verCmd&0xf > 1 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	h := &ProxyHeader{Version: 2, Local: verCmd&0xf == 0}
+
+	var addrLen int
+	switch family >> 4 {
+	case 0x1: // IPv4
+		addrLen = 2*net.IPv4len + 4
+	case 0x2: // IPv6
+		addrLen = 2*net.IPv6len + 4
+	case 0x3: // Unix
+		addrLen = 216
+	default:
+		// unspecified; whatever follows is ignored
+		return h, nil
+	}
+	if len(body) < addrLen {
+		return nil, errProxyHeader
+	}
+	if !h.Local && family>>4 != 0x3 {
+		n := (addrLen - 4) / 2
+		ports := body[2*n:]
+		src := &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(ports))}
+		dst := &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+		if family&0xf == 0x2 { // DGRAM
+			h.SourceAddr = &net.UDPAddr{IP: src.IP, Port: src.Port}
+			h.DestAddr = &net.UDPAddr{IP: dst.IP, Port: dst.Port}
+		} else {
+			h.SourceAddr, h.DestAddr = src, dst
+		}
+	}
+
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, errProxyHeader
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, errProxyHeader
+		}
+		if h.TLVs == nil {
+			h.TLVs = make(map[byte][]byte)
+		}
+		h.TLVs[tlvs[0]] = tlvs[3 : 3+n]
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
@@ -0,0 +1,184 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A v2 PROXY header for a TCP over IPv4 connection from 192.0.2.1:56324
+func proxyV2Header(tlvs ...[]byte) []byte {
+	var body bytes.Buffer
+	body.Write(net.ParseIP("192.0.2.1").To4())
+	body.Write(net.ParseIP("192.0.2.2").To4())
+	binary.Write(&body, binary.BigEndian, uint16(56324))
+	binary.Write(&body, binary.BigEndian, uint16(443))
+	for _, tlv := range tlvs {
+		body.Write(tlv)
+	}
+	var h bytes.Buffer
+	h.Write(proxyV2Sig)
+	h.Write([]byte{0x21, 0x11})
+	binary.Write(&h, binary.BigEndian, uint16(body.Len()))
+	h.Write(body.Bytes())
+	return h.Bytes()
+}
+
+func proxyTLV(typ byte, value string) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		source string
+		local  bool
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324", false, false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false, false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", true, false},
+		{"v2", string(proxyV2Header()), "192.0.2.1:56324", false, false},
+		{"v2 local", strings.Replace(string(proxyV2Header()), "\x21\x11", "\x20\x00", 1), "", true, false},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n", "", false, true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 99999 443\r\n", "", false, true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", false, true},
+		{"v2 bad tlv", string(proxyV2Header([]byte{ProxyTLVAuthority, 0, 9, 'x'})), "", false, true},
+		{"http", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "", false, true},
+	}
+	for _, test := range tests {
+		// the header is followed by the request, which must be left unread
+		r := strings.NewReader(test.header + "GET")
+		h, err := parseProxyHeader(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: Expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: Unexpected error %v", test.name, err)
+			continue
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "GET" {
+			t.Errorf("%v: Expected the request to be left, got %q", test.name, rest)
+		}
+		source := ""
+		if h.SourceAddr != nil {
+			source = h.SourceAddr.String()
+		}
+		if source != test.source || h.Local != test.local {
+			t.Errorf("%v: Expected source %q local %v, got %q %v", test.name, test.source, test.local, source, h.Local)
+		}
+	}
+
+	h, _ := parseProxyHeader(bytes.NewReader(proxyV2Header(proxyTLV(ProxyTLVAuthority, "example.com"), proxyTLV(ProxyTLVALPN, "h2"))))
+	if h.Authority() != "example.com" || h.ALPN() != "h2" {
+		t.Errorf("Expected authority and ALPN TLVs, got %q %q", h.Authority(), h.ALPN())
+	}
+}
+
+func startProxyServer(t *testing.T, tlsConfig *tls.Config, networks ...string) *Server {
+	nets, err := ParseCIDRs(networks...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := NewRequestFilter(func(req *Request) *http.Response {
+		authority := ""
+		if h := req.ProxyHeader(); h != nil {
+			authority = h.Authority()
+		}
+		return StringResponse(req.HttpRequest, 200, nil, req.ClientIP.String()+" "+authority)
+	})
+	return startTestServer(t, filter, func(srv *Server) {
+		srv.ProxyProtocolNetworks = nets
+		srv.TLSConfig = tlsConfig
+	})
+}
+
+func proxyRequest(t *testing.T, c net.Conn, header []byte) string {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write(header)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	srv := startProxyServer(t, nil, "127.0.0.1")
+
+	tests := []struct {
+		name     string
+		header   []byte
+		expected string
+	}{
+		{"v1", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 80\r\n"), "192.0.2.1 "},
+		{"v2", proxyV2Header(proxyTLV(ProxyTLVAuthority, "example.com")), "192.0.2.1 example.com"},
+		{"local", []byte("PROXY UNKNOWN\r\n"), "127.0.0.1 "},
+	}
+	for _, test := range tests {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", srv.Port()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := proxyRequest(t, c, test.header); body != test.expected {
+			t.Errorf("%v: Expected %q, got %q", test.name, test.expected, body)
+		}
+		c.Close()
+	}
+
+	// trusted sources must send the header
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", srv.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if body := proxyRequest(t, c, nil); !strings.HasPrefix(body, "error") {
+		t.Errorf("Expected a request without a header to fail, got %q", body)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	srv := startProxyServer(t, nil, "10.0.0.0/8")
+
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/", srv.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "127.0.0.1 " {
+		t.Errorf("Expected the connection's own address, got %q", body)
+	}
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+	srv := startProxyServer(t, testTLSConfig(t), "127.0.0.1")
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", srv.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the header comes before the handshake
+	c.Write(proxyV2Header(proxyTLV(ProxyTLVAuthority, "example.com")))
+	tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if body := proxyRequest(t, tc, nil); body != "192.0.2.1 example.com" {
+		t.Errorf("Expected the proxied client over TLS, got %q", body)
+	}
+}
@@ -1,7 +1,10 @@
 package falcore
 
 import (
+	"bufio"
 	"container/list"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -9,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"strings"
 	"time"
 )
 
@@ -17,7 +21,13 @@ import (
 // The request is wrapped so that useful information can be kept
 // with the request as it moves through the pipeline.
 //
-// A pointer is kept to the originating Connection.
+// A pointer is kept to the originating Connection.  RemoteAddr is
+// the connection's remote address.  Its type depends on the listener
+// the connection came from: *net.TCPAddr for TCP and *net.UnixAddr
+// (or nil) for Unix domain sockets.  ClientIP starts out as the IP of
+// RemoteAddr, nil for Unix domain sockets.  Filters that know better,
+// like filter.ForwardedFilter behind a proxy, replace it with the real
+// client's IP.  Use it for throttling, logging and access control.
 //
 // There is a unique ID assigned to each request.  This ID is not
 // globally unique to keep it shorter for logging purposes.  It is
@@ -36,6 +46,9 @@ import (
 //
 // See falcore.PipelineStageStat docs for more info.
 //
+// Params holds the values routers like router.PatternRouter captured
+// from the request, by name.  It's nil until a router sets one.
+//
 // The Signature is also a cool feature. See the
 type Request struct {
 	ID                 string
@@ -43,13 +56,20 @@ type Request struct {
 	EndTime            time.Time
 	HttpRequest        *http.Request
 	connection         net.Conn
-	RemoteAddr         *net.TCPAddr
+	RemoteAddr         net.Addr
+	ClientIP           net.IP
 	PipelineStageStats *list.List
 	CurrentStage       *PipelineStageStat
 	pipelineHash       hash.Hash32
 	piplineTot         time.Duration
 	Overhead           time.Duration
 	Context            map[string]interface{}
+	Params             map[string]string
+	maxBodyBytes       int64
+	bodyTooLarge       bool
+	hijacker           func() (net.Conn, *bufio.ReadWriter, error)
+	hijacked           bool
+	errorHandler       func(req *Request, err error) *http.Response
 }
 
 // Used internally to create and initialize a new request.
@@ -60,7 +80,14 @@ func NewRequest(request *http.Request, conn net.Conn, startTime time.Time) *Requ
 	fReq.StartTime = startTime
 	fReq.connection = conn
 	if conn != nil {
-		fReq.RemoteAddr = conn.RemoteAddr().(*net.TCPAddr)
+		fReq.RemoteAddr = conn.RemoteAddr()
+		fReq.ClientIP = addrIP(fReq.RemoteAddr)
+	} else if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		fReq.ClientIP = net.ParseIP(host)
+	}
+	if tc, ok := conn.(*tls.Conn); ok && request.TLS == nil {
+		state := tc.ConnectionState()
+		request.TLS = &state
 	}
 
 	// create a semi-unique id to track a connection in the logs
@@ -82,6 +109,58 @@ func NewRequest(request *http.Request, conn net.Conn, startTime time.Time) *Requ
 	return fReq
 }
 
+// The client's certificate, if it sent one and it was verified against
+// the server's tls.Config.ClientCAs.  Nil otherwise.
+func (fReq *Request) ClientCertificate() *x509.Certificate {
+	if chains := fReq.VerifiedChains(); len(chains) > 0 && len(chains[0]) > 0 {
+		return chains[0][0]
+	}
+	return nil
+}
+
+// The verified chains of the client's certificate, leaf first, from
+// the TLS connection state.  Nil for plain connections and for
+// certificates that weren't verified.
+func (fReq *Request) VerifiedChains() [][]*x509.Certificate {
+	if fReq.HttpRequest == nil || fReq.HttpRequest.TLS == nil {
+		return nil
+	}
+	return fReq.HttpRequest.TLS.VerifiedChains
+}
+
+// The PROXY protocol header the connection started with, or nil.  See
+// Server.ProxyProtocolNetworks.
+func (fReq *Request) ProxyHeader() *ProxyHeader {
+	if fReq.connection == nil {
+		return nil
+	}
+	if pc := asProxyConn(fReq.connection); pc != nil {
+		return pc.header
+	}
+	return nil
+}
+
+// Reports whether the comma separated header name, like Connection or
+// Upgrade, contains token, ignoring case
+func HeaderHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The IP of a TCP address, or nil
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
+
 // Returns a completed falcore.Request and response after running the single filter stage
 // The PipelineStageStats is completed in the returned Request
 // The falcore.Request.Connection and falcore.Request.RemoteAddr are nil
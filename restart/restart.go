@@ -0,0 +1,196 @@
+// Package restart implements zero-downtime restarts for falcore servers.
+//
+// The running process starts a new copy of its own binary and hands it
+// the server's listening sockets as inherited file descriptors.  Once
+// the new process is accepting connections it tells the old one, which
+// then drains its connections with Server.Shutdown.  No connections are
+// refused while the restart is in progress.
+//
+// A server supports restarts by calling Inherit before serving and
+// Restart whenever it wants to be replaced:
+//
+//	srv := falcore.NewServer(8080, pipeline)
+//	if err := restart.Inherit(srv); err != nil {
+//		log.Fatal(err)
+//	}
+//	go func() {
+//		for range hup {
+//			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//			if err := restart.Restart(ctx, srv); err != nil {
+//				log.Println("restart failed:", err)
+//			}
+//			cancel()
+//		}
+//	}()
+//	srv.ListenAndServe()
+package restart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/fitstar/falcore"
+)
+
+// Environment variables used to hand state from the old process to the
+// new one.  Inherited descriptors start at fd 3, listeners first,
+// followed by the ready pipe.
+const (
+	// Number of inherited listening sockets
+	EnvListenFds = "FALCORE_LISTEN_FDS"
+	// Descriptor the new process writes to once it is accepting
+	EnvReadyFd = "FALCORE_READY_FD"
+	// Pid of the process that started us.  Guards against the other
+	// variables leaking into unrelated processes.
+	EnvParentPid = "FALCORE_PARENT_PID"
+)
+
+// First inherited descriptor, after stdin, stdout and stderr
+const listenFdsStart = 3
+
+// Returned by Restart if the new process exits before it is ready
+var ErrChildExited = errors.New("restart: new process exited before accepting connections")
+
+// Reports whether this process was started by Restart
+func Inherited() bool {
+	pid := os.Getenv(EnvParentPid)
+	return pid != "" && pid == strconv.Itoa(os.Getppid())
+}
+
+// Sets up srv to serve on the listeners inherited from the process that
+// started us.  Once srv is accepting connections, the old process is
+// told it can shut down.  Does nothing if this process wasn't started
+// by Restart, so it is safe to call unconditionally.
+func Inherit(srv *falcore.Server) error {
+	if !Inherited() {
+		return nil
+	}
+	defer unsetEnv()
+
+	n, err := strconv.Atoi(os.Getenv(EnvListenFds))
+	if err != nil || n < 1 {
+		return fmt.Errorf("restart: bad %s: %q", EnvListenFds, os.Getenv(EnvListenFds))
+	}
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		if err := srv.FdListen(fd, fmt.Sprintf("inherited:%d", fd)); err != nil {
+			return err
+		}
+	}
+
+	readyFd, err := strconv.Atoi(os.Getenv(EnvReadyFd))
+	if err != nil {
+		return fmt.Errorf("restart: bad %s: %q", EnvReadyFd, os.Getenv(EnvReadyFd))
+	}
+	ready := os.NewFile(uintptr(readyFd), "ready")
+	go func() {
+		<-srv.AcceptReady
+		ready.Write([]byte{1})
+		ready.Close()
+	}()
+	return nil
+}
+
+// Starts a new copy of the running binary with the same arguments,
+// handing it srv's listeners.  Once the new process is accepting
+// connections, srv is drained with Shutdown.  ctx bounds both waiting
+// for the new process and the shutdown.  If the new process isn't ready
+// in time it is killed and srv keeps serving.
+func Restart(ctx context.Context, srv *falcore.Server) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	files, err := srv.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("restart: server has no listeners")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		closeAll(files)
+		return err
+	}
+	defer r.Close()
+
+	files = append(files, w)
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(cleanEnv(),
+		fmt.Sprintf("%s=%d", EnvListenFds, len(files)-1),
+		fmt.Sprintf("%s=%d", EnvReadyFd, listenFdsStart+len(files)-1),
+		fmt.Sprintf("%s=%d", EnvParentPid, os.Getpid()),
+	)
+	// The child has its own copies now.  Closing ours means the read
+	// below sees EOF if the child dies before it is ready.
+	err = cmd.Start()
+	closeAll(files)
+	if err != nil {
+		return err
+	}
+	falcore.Info("restart: started pid %d, waiting for it to accept", cmd.Process.Pid)
+
+	// Reap the child if it dies while we are still around
+	go cmd.Wait()
+
+	readyc := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if n, _ := r.Read(b[:]); n == 1 {
+			readyc <- nil
+		} else {
+			readyc <- ErrChildExited
+		}
+	}()
+
+	select {
+	case err = <-readyc:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return ctx.Err()
+	}
+
+	falcore.Info("restart: pid %d is accepting, shutting down", cmd.Process.Pid)
+	return srv.Shutdown(ctx)
+}
+
+// Our environment without any restart variables inherited from a
+// previous generation.
+func cleanEnv() []string {
+	env := os.Environ()
+	clean := env[:0:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, EnvListenFds+"=") &&
+			!strings.HasPrefix(kv, EnvReadyFd+"=") &&
+			!strings.HasPrefix(kv, EnvParentPid+"=") {
+			clean = append(clean, kv)
+		}
+	}
+	return clean
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func unsetEnv() {
+	os.Unsetenv(EnvListenFds)
+	os.Unsetenv(EnvReadyFd)
+	os.Unsetenv(EnvParentPid)
+}
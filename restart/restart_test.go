@@ -0,0 +1,225 @@
+package restart
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/internal/falcoretest"
+)
+
+// The test binary re-executes itself during TestRestart.  The copy
+// started by Restart serves as the new generation instead of running
+// the tests.
+func TestMain(m *testing.M) {
+	if Inherited() {
+		runChild()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runChild() {
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/exit" {
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				os.Exit(0)
+			}()
+		}
+		return falcore.StringResponse(req.HttpRequest, 200, nil, "child")
+	}))
+	srv := falcore.NewServer(0, pipeline)
+	if err := Inherit(srv); err != nil {
+		fmt.Fprintln(os.Stderr, "inherit failed:", err)
+		os.Exit(2)
+	}
+	if Inherited() {
+		fmt.Fprintln(os.Stderr, "environment not cleaned up")
+		os.Exit(2)
+	}
+	// Don't hang around forever if the test goes wrong
+	time.AfterFunc(30*time.Second, func() { os.Exit(3) })
+	if dir := os.Getenv(envTestCertDir); dir != "" {
+		srv.ListenAndServeTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+		return
+	}
+	srv.ListenAndServe()
+}
+
+// Set for the child in TestRestartTLS
+const envTestCertDir = "FALCORE_TEST_CERT_DIR"
+
+// Writes a self-signed certificate for localhost to dir
+func writeCert(t *testing.T, dir string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func get(t *testing.T, port int, path string) string {
+	return getURL(t, &http.Transport{DisableKeepAlives: true}, fmt.Sprintf("http://localhost:%v%v", port, path))
+}
+
+func getURL(t *testing.T, transport *http.Transport, url string) string {
+	c := &http.Client{Transport: transport}
+	res, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("Couldn't get %v: %v", url, err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func parentFilter() falcore.RequestFilter {
+	return falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		return falcore.StringResponse(req.HttpRequest, 200, nil, "parent")
+	})
+}
+
+func TestRestart(t *testing.T) {
+	srv := falcoretest.StartServer(t, parentFilter(), nil)
+	port := srv.Port()
+
+	if body := get(t, port, "/"); body != "parent" {
+		t.Fatalf("Expected parent response, got %q", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := Restart(ctx, srv); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+
+	if body := get(t, port, "/"); body != "child" {
+		t.Errorf("Expected child response, got %q", body)
+	}
+	get(t, port, "/exit")
+}
+
+func TestRestartTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := falcoretest.StartServer(t, parentFilter(), func(srv *falcore.Server) {
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	})
+	port := srv.Port()
+	get := func(path string) string {
+		transport := &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		}
+		return getURL(t, transport, fmt.Sprintf("https://localhost:%v%v", port, path))
+	}
+
+	if body := get("/"); body != "parent" {
+		t.Fatalf("Expected parent response, got %q", body)
+	}
+
+	os.Setenv(envTestCertDir, dir)
+	defer os.Unsetenv(envTestCertDir)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := Restart(ctx, srv); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+
+	if body := get("/"); body != "child" {
+		t.Errorf("Expected child response, got %q", body)
+	}
+	get("/exit")
+}
+
+// A connection the parent accepted before the restart is still served
+// by the parent, even if its request comes once the child has taken
+// over
+func TestRestartOpenConnection(t *testing.T) {
+	srv := falcoretest.StartServer(t, parentFilter(), nil)
+	port := srv.Port()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", port))
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; srv.Connections() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	restarted := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		restarted <- Restart(ctx, srv)
+	}()
+	for i := 0; get(t, port, "/") != "child"; i++ {
+		if i == 100 {
+			t.Fatal("The child never took over")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Couldn't read response on the open connection: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "parent" {
+		t.Errorf("Expected parent response, got %q", body)
+	}
+	if err := <-restarted; err != nil {
+		t.Errorf("Restart failed: %v", err)
+	}
+	get(t, port, "/exit")
+}
+
+func TestNotInherited(t *testing.T) {
+	srv := falcore.NewServer(0, falcore.NewPipeline())
+	if err := Inherit(srv); err != nil {
+		t.Errorf("Inherit should be a no-op: %v", err)
+	}
+	if srv.Port() != 0 {
+		t.Errorf("Inherit shouldn't have set up a listener")
+	}
+}
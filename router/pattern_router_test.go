@@ -0,0 +1,210 @@
+package router
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fitstar/falcore"
+)
+
+func patternRequest(path string) *falcore.Request {
+	tmp, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	req, _ := falcore.TestWithRequest(tmp, falcore.NewRequestFilter(func(req *falcore.Request) *http.Response { return nil }), nil)
+	return req
+}
+
+func TestPatternRouter(t *testing.T) {
+	r := NewPatternRouter()
+	patterns := []string{
+		"/",
+		"/users",
+		"/users/",
+		"/users/new",
+		"/users/:id",
+		"/users/:id/edit",
+		"/users/:id/posts/*rest",
+		"/users/new/posts",
+		"/static/*",
+		"/*path",
+	}
+	for i, p := range patterns {
+		if err := r.AddMatch(p, SimpleFilter(i)); err != nil {
+			t.Fatalf("AddMatch(%q): %v", p, err)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		pattern string
+		params  map[string]string
+	}{
+		{"/", "/", nil},
+		{"/users", "/users", nil},
+		{"/users/", "/users/", nil},
+		{"/users/new", "/users/new", nil},
+		{"/users/42", "/users/:id", map[string]string{"id": "42"}},
+		{"/users/new/edit", "/users/:id/edit", map[string]string{"id": "new"}},
+		{"/users/42/posts/", "/users/:id/posts/*rest", map[string]string{"id": "42", "rest": ""}},
+		{"/users/42/posts/2014/01/hello", "/users/:id/posts/*rest", map[string]string{"id": "42", "rest": "2014/01/hello"}},
+		{"/users/new/posts", "/users/new/posts", nil},
+		{"/users/a%2Fb", "/users/:id", map[string]string{"id": "a/b"}},
+		{"/users/42/posts", "/*path", map[string]string{"path": "users/42/posts"}},
+		{"/static/css/site.css", "/static/*", nil},
+		{"/other", "/*path", map[string]string{"path": "other"}},
+	}
+	for _, test := range tests {
+		req := patternRequest(test.path)
+		pipe := r.SelectPipeline(req)
+		if pipe == nil {
+			t.Errorf("%v: No match", test.path)
+			continue
+		}
+		if p := patterns[pipe.(SimpleFilter)]; p != test.pattern {
+			t.Errorf("%v: Expected to match %v, got %v", test.path, test.pattern, p)
+		}
+		if !reflect.DeepEqual(req.Params, test.params) {
+			t.Errorf("%v: Expected params %v, got %v", test.path, test.params, req.Params)
+		}
+	}
+}
+
+func TestPatternRouterNoMatch(t *testing.T) {
+	r := NewPatternRouter()
+	r.AddMatch("/users/:id", SimpleFilter(1))
+	r.AddMatch("/files/*path", SimpleFilter(2))
+	for _, path := range []string{"/", "/users", "/users/", "/users/42/edit", "/files"} {
+		req := patternRequest(path)
+		if pipe := r.SelectPipeline(req); pipe != nil {
+			t.Errorf("%v: Expected no match, got %v", path, pipe)
+		}
+		if req.Params != nil {
+			t.Errorf("%v: Expected no params, got %v", path, req.Params)
+		}
+	}
+}
+
+func TestPatternRouterErrors(t *testing.T) {
+	r := NewPatternRouter()
+	r.AddMatch("/users/:id", SimpleFilter(1))
+	r.AddMatch("/files/*path", SimpleFilter(2))
+	for _, pattern := range []string{
+		"users",
+		"/users/:",
+		"/users/:name",
+		"/files/*name",
+		"/files/*path/more",
+	} {
+		if err := r.AddMatch(pattern, SimpleFilter(3)); err == nil {
+			t.Errorf("%v: Expected an error", pattern)
+		}
+	}
+}
+
+func TestPatternRouterMethods(t *testing.T) {
+	endpoint := func(name string) falcore.RequestFilter {
+		return falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+			return falcore.StringResponse(req.HttpRequest, 200, nil, name+" "+req.Params["id"])
+		})
+	}
+	r := NewPatternRouter()
+	r.AddMethodMatch("GET", "/users/:id", endpoint("show"))
+	r.AddMethodMatch("PUT", "/users/:id", endpoint("update"))
+	r.AddMethodMatch("DELETE", "/users/:id", endpoint("delete"))
+	r.AddMethodMatch("POST", "/users", endpoint("create"))
+	r.AddMatch("/any", endpoint("any"))
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(r)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+		allow  string
+	}{
+		{"GET", "/users/42", 200, "show 42", ""},
+		{"PUT", "/users/42", 200, "update 42", ""},
+		{"DELETE", "/users/42", 200, "delete 42", ""},
+		{"POST", "/users/42", 405, "Method Not Allowed\n", "DELETE, GET, HEAD, OPTIONS, PUT"},
+		{"OPTIONS", "/users/42", 204, "", "DELETE, GET, HEAD, OPTIONS, PUT"},
+		{"HEAD", "/users/42", 200, "", ""},
+		{"POST", "/users", 200, "create ", ""},
+		{"GET", "/users", 405, "Method Not Allowed\n", "OPTIONS, POST"},
+		{"HEAD", "/users", 405, "Method Not Allowed\n", "OPTIONS, POST"},
+		{"PATCH", "/any", 200, "any ", ""},
+		{"OPTIONS", "/any", 200, "any ", ""},
+	}
+	for _, test := range tests {
+		tmp, _ := http.NewRequest(test.method, "http://example.com"+test.path, nil)
+		_, res := falcore.TestWithRequest(tmp, pipeline, nil)
+		if res.StatusCode != test.status {
+			t.Errorf("%v %v: Expected status %v, got %v", test.method, test.path, test.status, res.StatusCode)
+		}
+		var body []byte
+		if res.Body != nil {
+			body, _ = ioutil.ReadAll(res.Body)
+		}
+		if string(body) != test.body {
+			t.Errorf("%v %v: Expected body %q, got %q", test.method, test.path, test.body, body)
+		}
+		if allow := res.Header.Get("Allow"); allow != test.allow {
+			t.Errorf("%v %v: Expected Allow %q, got %q", test.method, test.path, test.allow, allow)
+		}
+	}
+
+	// HEAD keeps the GET's length, and its stage
+	tmp, _ := http.NewRequest("HEAD", "http://example.com/users/42", nil)
+	req, res := falcore.TestWithRequest(tmp, pipeline, nil)
+	if res.ContentLength != int64(len("show 42")) {
+		t.Errorf("HEAD: Expected ContentLength %v, got %v", len("show 42"), res.ContentLength)
+	}
+	var stages []string
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		stages = append(stages, e.Value.(*falcore.PipelineStageStat).Name)
+	}
+	if s := strings.Join(stages, " "); !strings.Contains(s, "*falcore.genericRequestFilter router.headBodyFilter") {
+		t.Errorf("HEAD: Expected the GET filter's stage, then the body dropped, got %v", s)
+	}
+}
+
+func BenchmarkPatternRouter(b *testing.B) {
+	r := NewPatternRouter()
+	for i := 0; i < 500; i++ {
+		r.AddMatch(fmt.Sprintf("/resource%d/:id/items/:item", i), SimpleFilter(i))
+	}
+	req := patternRequest("/resource499/42/items/7")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req.Params = nil
+		r.SelectPipeline(req)
+	}
+}
+
+// The worst case for falling back: every level has a static and a
+// parameter branch, and the path only fails at the last segment, so
+// the lookup tries every node in the tree
+func BenchmarkPatternRouterFallback(b *testing.B) {
+	const depth = 10
+	r := NewPatternRouter()
+	for i := 0; i < 1<<depth; i++ {
+		pattern := ""
+		for j := 0; j < depth; j++ {
+			if i&(1<<j) != 0 {
+				pattern += fmt.Sprintf("/:p%d", j)
+			} else {
+				pattern += "/s"
+			}
+		}
+		r.AddMatch(pattern+"/end", SimpleFilter(i))
+	}
+	req := patternRequest(strings.Repeat("/s", depth) + "/miss")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req.Params = nil
+		r.SelectPipeline(req)
+	}
+}
@@ -2,8 +2,11 @@ package router
 
 import (
 	"container/list"
+	"fmt"
 	"github.com/fitstar/falcore"
+	"net"
 	"regexp"
+	"strings"
 )
 
 // Interface for defining individual routes
@@ -34,25 +37,111 @@ func (r *RegexpRoute) MatchString(str string) falcore.RequestFilter {
 	return nil
 }
 
-// Route requsts based on hostname
+// Route requsts based on hostname.  Hosts are matched without their
+// port and ignoring case.  Patterns can have wildcard labels: "*"
+// matches any one label and ":name" matches one and stores it in
+// Request.Params under name.  For one subdomain per customer,
+//
+//	hr.AddMatch(":tenant.example.com", tenants)
+//
+// routes "acme.example.com" with Params["tenant"] set to "acme".  Exact
+// labels take priority over wildcards.  Requests for hosts that don't
+// match go to Default, if it's set.
 type HostRouter struct {
-	hosts map[string]falcore.RequestFilter
+	Default falcore.RequestFilter
+	root    *hostNode
+}
+
+type hostNode struct {
+	static map[string]*hostNode
+	// matches any one label; captured if it has a name
+	wildcard *hostNode
+	name     string
+	filter   falcore.RequestFilter
 }
 
 // Generate a new HostRouter instance
 func NewHostRouter() *HostRouter {
 	r := new(HostRouter)
-	r.hosts = make(map[string]falcore.RequestFilter)
+	r.root = new(hostNode)
 	return r
 }
 
-// TODO: support for non-exact matches
-func (r *HostRouter) AddMatch(host string, pipe falcore.RequestFilter) {
-	r.hosts[host] = pipe
+// Returns an error for wildcard names that conflict with an earlier
+// pattern's, like ":customer.example.com" after ":tenant.example.com"
+func (r *HostRouter) AddMatch(host string, pipe falcore.RequestFilter) error {
+	n := r.root
+	labels := hostLabels(host)
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := labels[i]
+		if label == "*" || strings.HasPrefix(label, ":") {
+			name := label[1:]
+			if n.wildcard == nil {
+				n.wildcard = &hostNode{name: name}
+			} else if n.wildcard.name != name {
+				return fmt.Errorf("router: %q in host %q conflicts with an earlier pattern", label, host)
+			}
+			n = n.wildcard
+			continue
+		}
+		if n.static == nil {
+			n.static = make(map[string]*hostNode)
+		}
+		child := n.static[label]
+		if child == nil {
+			child = new(hostNode)
+			n.static[label] = child
+		}
+		n = child
+	}
+	n.filter = pipe
+	return nil
 }
 
 func (r *HostRouter) SelectPipeline(req *falcore.Request) (pipe falcore.RequestFilter) {
-	return r.hosts[req.HttpRequest.Host]
+	n, params := r.root.lookup(hostLabels(req.HttpRequest.Host), nil)
+	if n == nil {
+		return r.Default
+	}
+	setParams(req, params)
+	return n.filter
+}
+
+// Finds the node for labels, matching from the last one.  params
+// collects name, value pairs along the way.
+func (n *hostNode) lookup(labels []string, params []string) (*hostNode, []string) {
+	if len(labels) == 0 {
+		if n.filter != nil {
+			return n, params
+		}
+		return nil, nil
+	}
+	label, rest := labels[len(labels)-1], labels[:len(labels)-1]
+	if child := n.static[label]; child != nil {
+		if found, p := child.lookup(rest, params); found != nil {
+			return found, p
+		}
+	}
+	if n.wildcard != nil && label != "" {
+		if n.wildcard.name != "" {
+			params = append(params, n.wildcard.name, label)
+		}
+		return n.wildcard.lookup(rest, params)
+	}
+	return nil, nil
+}
+
+// The lower case labels of host, without any port or trailing dot
+func hostLabels(host string) []string {
+	// ":name" labels look like ports
+	if h, port, err := net.SplitHostPort(host); err == nil && strings.Trim(port, "0123456789") == "" {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return nil
+	}
+	return strings.Split(host, ".")
 }
 
 // Route requests based on path
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/fitstar/falcore"
 	"net/http"
+	"reflect"
 	"regexp"
 	"testing"
 )
@@ -59,3 +60,51 @@ func TestHostRouter(t *testing.T) {
 		t.Errorf("Host router got currently unsupported fuzzy match so you should update this test")
 	}
 }
+
+func TestHostRouterWildcards(t *testing.T) {
+	hr := NewHostRouter()
+	var sf1, sf2, sf3, sf4 SimpleFilter = 1, 2, 3, 4
+	hr.AddMatch("example.com", sf1)
+	hr.AddMatch("www.example.com", sf2)
+	hr.AddMatch(":tenant.example.com", sf3)
+	hr.AddMatch("*.:region.example.net", sf4)
+	if err := hr.AddMatch(":customer.example.com", sf1); err == nil {
+		t.Errorf("Expected an error for a conflicting wildcard name")
+	}
+
+	tests := []struct {
+		host   string
+		filter falcore.RequestFilter
+		params map[string]string
+	}{
+		{"example.com", sf1, nil},
+		{"Example.COM:8080", sf1, nil},
+		{"example.com.", sf1, nil},
+		{"www.example.com", sf2, nil},
+		{"acme.example.com", sf3, map[string]string{"tenant": "acme"}},
+		{"ACME.example.com:443", sf3, map[string]string{"tenant": "acme"}},
+		{"a.b.example.com", nil, nil},
+		{"host1.us-east.example.net", sf4, map[string]string{"region": "us-east"}},
+		{"us-east.example.net", nil, nil},
+		{"example.org", nil, nil},
+		{"", nil, nil},
+	}
+	for _, test := range tests {
+		req := validGetRequest()
+		req.HttpRequest.Host = test.host
+		if filt := hr.SelectPipeline(req); filt != test.filter {
+			t.Errorf("%q: Expected %v, got %v", test.host, test.filter, filt)
+		}
+		if !reflect.DeepEqual(req.Params, test.params) {
+			t.Errorf("%q: Expected params %v, got %v", test.host, test.params, req.Params)
+		}
+	}
+
+	var sf5 SimpleFilter = 5
+	hr.Default = sf5
+	req := validGetRequest()
+	req.HttpRequest.Host = "example.org"
+	if filt := hr.SelectPipeline(req); filt != sf5 {
+		t.Errorf("Expected the default pipeline, got %v", filt)
+	}
+}
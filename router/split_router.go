@@ -0,0 +1,183 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fitstar/falcore"
+)
+
+// Sends a share of the traffic to alternate pipelines, for canary
+// releases, like a pipeline with an Upstream for the new version, and
+// experiments.  Each variant gets the percentage of
+// requests set with SetWeights and the control gets the rest.
+//
+// Clients stay in the same arm: requests are assigned to one of 10000
+// buckets by a hash of Key, the client's IP by default.  The first
+// SetWeights gives the variants consecutive ranges of buckets, in
+// order, and the control keeps the rest.  After that a variant whose
+// weight drops gives up the buckets at the end of what it has, and one
+// whose weight grows takes the lowest buckets the control has, so only
+// clients moving in or out of that variant change arms.  The layout
+// only depends on the weights set so far, so servers sharing a Key and
+// given the same weights in the same order agree.  Weights can be
+// changed while serving.
+//
+// Requests sent to a variant get a CurrentStage.Status of 3 for the
+// first variant, 4 for the second and so on, so the stats and
+// Request.Signature tell the arms apart.
+type SplitRouter struct {
+	// The value clients are assigned by.  See SplitByCookie and
+	// SplitByHeader.  Requests it returns "" for, and all requests if
+	// it's nil, are assigned by Request.ClientIP.
+	Key      func(req *falcore.Request) string
+	control  falcore.RequestFilter
+	variants []falcore.RequestFilter
+	// *splitLayout, replaced as a whole by SetWeights
+	layout atomic.Value
+	// serializes SetWeights
+	mu sync.Mutex
+}
+
+// Which arm each bucket goes to
+type splitLayout struct {
+	// 0 for the control, i+1 for variant i
+	owners []uint8
+	// how many buckets each variant has
+	sizes []uint32
+}
+
+// Type check
+var _ falcore.Router = new(SplitRouter)
+
+// Clients are split into this many buckets, so weights have a
+// resolution of 0.01%
+const splitBuckets = 10000
+
+// The Status of the router's stage for the first variant.  0, 1 and 2
+// already mean ok, skip and fail.
+const splitVariantStatus = 3
+
+// Variants' Statuses have to fit in a byte
+const maxSplitVariants = 255 - splitVariantStatus + 1
+
+// Generate a new SplitRouter.  All traffic goes to control until
+// SetWeights is called.
+func NewSplitRouter(control falcore.RequestFilter, variants ...falcore.RequestFilter) *SplitRouter {
+	r := &SplitRouter{control: control, variants: variants}
+	r.layout.Store(&splitLayout{
+		owners: make([]uint8, splitBuckets),
+		sizes:  make([]uint32, len(variants)),
+	})
+	return r
+}
+
+// Set the percentage of traffic each variant gets, in the order they
+// were given to NewSplitRouter.  They can add up to at most 100.
+func (r *SplitRouter) SetWeights(percents ...float64) error {
+	if len(percents) != len(r.variants) {
+		return fmt.Errorf("router: %d weights for %d variants", len(percents), len(r.variants))
+	}
+	if len(r.variants) > maxSplitVariants {
+		return fmt.Errorf("router: %d variants is over the limit of %d", len(r.variants), maxSplitVariants)
+	}
+	sizes := make([]uint32, len(percents))
+	var total uint32
+	for i, p := range percents {
+		if p < 0 || math.IsNaN(p) || p > 100 {
+			return fmt.Errorf("router: invalid weight %v", p)
+		}
+		sizes[i] = uint32(math.Round(p * splitBuckets / 100))
+		total += sizes[i]
+	}
+	if total > splitBuckets {
+		return fmt.Errorf("router: weights %v add up to over 100", percents)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.layout.Load().(*splitLayout)
+	owners := make([]uint8, splitBuckets)
+	copy(owners, old.owners)
+
+	// shrink first so the buckets given up can be taken by the others
+	for i, size := range sizes {
+		have := old.sizes[i]
+		for b := splitBuckets - 1; have > size; b-- {
+			if owners[b] == uint8(i+1) {
+				owners[b] = 0
+				have--
+			}
+		}
+	}
+	for i, size := range sizes {
+		have := old.sizes[i]
+		for b := 0; have < size; b++ {
+			if owners[b] == 0 {
+				owners[b] = uint8(i + 1)
+				have++
+			}
+		}
+	}
+	r.layout.Store(&splitLayout{owners: owners, sizes: sizes})
+	return nil
+}
+
+// The current percentage of traffic each variant gets
+func (r *SplitRouter) Weights() []float64 {
+	sizes := r.layout.Load().(*splitLayout).sizes
+	percents := make([]float64, len(sizes))
+	for i, size := range sizes {
+		percents[i] = float64(size) * 100 / splitBuckets
+	}
+	return percents
+}
+
+func (r *SplitRouter) SelectPipeline(req *falcore.Request) (pipe falcore.RequestFilter) {
+	if owner := r.layout.Load().(*splitLayout).owners[r.bucket(req)]; owner != 0 {
+		req.CurrentStage.Status = splitVariantStatus + owner - 1
+		return r.variants[owner-1]
+	}
+	return r.control
+}
+
+func (r *SplitRouter) bucket(req *falcore.Request) uint32 {
+	var key string
+	if r.Key != nil {
+		key = r.Key(req)
+	}
+	if key == "" && req.ClientIP != nil {
+		key = req.ClientIP.String()
+	}
+	if key == "" {
+		// nothing to stick to
+		key = req.ID
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % splitBuckets
+}
+
+// A SplitRouter.Key that assigns clients by the value of the cookie
+// name, like a session or visitor ID
+func SplitByCookie(name string) func(req *falcore.Request) string {
+	return func(req *falcore.Request) string {
+		if c, err := req.HttpRequest.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+}
+
+// A SplitRouter.Key that assigns clients by the value of the header
+// name, like a user or API key ID set by an earlier filter
+func SplitByHeader(name string) func(req *falcore.Request) string {
+	name = http.CanonicalHeaderKey(name)
+	return func(req *falcore.Request) string {
+		return req.HttpRequest.Header.Get(name)
+	}
+}
@@ -0,0 +1,178 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/fitstar/falcore"
+)
+
+func TestSplitRouter(t *testing.T) {
+	var control, canary SplitFilterCounter
+	r := NewSplitRouter(&control, &canary)
+	if err := r.SetWeights(10); err != nil {
+		t.Fatal(err)
+	}
+
+	arms := make(map[string]falcore.RequestFilter)
+	for i := 0; i < 10000; i++ {
+		req := validGetRequest()
+		req.ClientIP = net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		pipe := r.SelectPipeline(req)
+		pipe.FilterRequest(req)
+		if (pipe == &canary) != (req.CurrentStage.Status == 3) {
+			t.Errorf("%v: Status %v doesn't match the arm", req.ClientIP, req.CurrentStage.Status)
+		}
+		arms[req.ClientIP.String()] = pipe
+	}
+	if canary < 800 || canary > 1200 {
+		t.Errorf("Expected about 10%% in the canary, got %v/%v", canary, canary+control)
+	}
+
+	// sticky, and ramping up keeps the canary's clients
+	if err := r.SetWeights(50); err != nil {
+		t.Fatal(err)
+	}
+	for ip, arm := range arms {
+		req := validGetRequest()
+		req.ClientIP = net.ParseIP(ip)
+		if pipe := r.SelectPipeline(req); arm == &canary && pipe != &canary {
+			t.Errorf("%v: Moved out of the canary", ip)
+			break
+		}
+	}
+	if w := r.Weights(); len(w) != 1 || w[0] != 50 {
+		t.Errorf("Expected weights [50], got %v", w)
+	}
+}
+
+func TestSplitRouterKey(t *testing.T) {
+	var a, b, c SimpleFilter = 1, 2, 3
+	r := NewSplitRouter(a, b, c)
+	r.Key = SplitByCookie("visitor")
+	if err := r.SetWeights(30, 30); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[falcore.RequestFilter]bool)
+	for i := 0; i < 100; i++ {
+		visitor := fmt.Sprintf("v%d", i)
+		var first falcore.RequestFilter
+		for j := 0; j < 3; j++ {
+			req := validGetRequest()
+			req.ClientIP = net.IPv4(10, 0, 0, byte(j))
+			req.HttpRequest.AddCookie(&http.Cookie{Name: "visitor", Value: visitor})
+			pipe := r.SelectPipeline(req)
+			if first == nil {
+				first = pipe
+			} else if pipe != first {
+				t.Errorf("%v: Expected the same arm from every IP", visitor)
+			}
+		}
+		seen[first] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected all 3 arms to be used, got %v", seen)
+	}
+
+	r.Key = SplitByHeader("x-user")
+	req := validGetRequest()
+	req.HttpRequest.Header.Set("X-User", "v1")
+	req2 := validGetRequest()
+	req2.HttpRequest.Header.Set("X-User", "v1")
+	req2.ClientIP = net.IPv4(192, 0, 2, 1)
+	if r.SelectPipeline(req) != r.SelectPipeline(req2) {
+		t.Errorf("Expected the same arm for the same header")
+	}
+}
+
+func TestSplitRouterWeights(t *testing.T) {
+	var a, b, c SimpleFilter = 1, 2, 3
+	r := NewSplitRouter(a, b, c)
+	for _, weights := range [][]float64{{10}, {10, 20, 30}, {60, 50}, {-1, 10}, {101, 0}} {
+		if err := r.SetWeights(weights...); err == nil {
+			t.Errorf("%v: Expected an error", weights)
+		}
+	}
+	if pipe := r.SelectPipeline(validGetRequest()); pipe != a {
+		t.Errorf("Expected everything to go to the control, got %v", pipe)
+	}
+
+	if err := r.SetWeights(70, 20); err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[falcore.RequestFilter]int)
+	for i := 0; i < 10000; i++ {
+		req := validGetRequest()
+		req.ClientIP = net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		counts[r.SelectPipeline(req)]++
+	}
+	if counts[b] < 6500 || counts[b] > 7500 || counts[c] < 1500 || counts[c] > 2500 {
+		t.Errorf("Expected about 10/70/20, got %v", counts)
+	}
+
+	if err := r.SetWeights(0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if pipe := r.SelectPipeline(validGetRequest()); pipe != c {
+		t.Errorf("Expected everything to go to the last variant, got %v", pipe)
+	}
+}
+
+// Changing one variant's weight only moves clients in or out of that
+// variant
+func TestSplitRouterStable(t *testing.T) {
+	var a, b, c SimpleFilter = 1, 2, 3
+	r := NewSplitRouter(a, b, c)
+	arms := func() []falcore.RequestFilter {
+		pipes := make([]falcore.RequestFilter, 10000)
+		for i := range pipes {
+			req := validGetRequest()
+			req.ClientIP = net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+			pipes[i] = r.SelectPipeline(req)
+		}
+		return pipes
+	}
+
+	steps := []struct {
+		weights []float64
+		changed falcore.RequestFilter
+	}{
+		{[]float64{10, 10}, nil},
+		{[]float64{20, 10}, b},
+		{[]float64{20, 5}, c},
+		{[]float64{5, 5}, b},
+		{[]float64{5, 30}, c},
+		{[]float64{5, 90}, c},
+		{[]float64{5, 40}, c},
+		{[]float64{60, 40}, b},
+		{[]float64{60, 10}, c},
+		{[]float64{0, 10}, b},
+		{[]float64{0, 100}, c},
+	}
+	var before []falcore.RequestFilter
+	for _, step := range steps {
+		if err := r.SetWeights(step.weights...); err != nil {
+			t.Fatal(err)
+		}
+		after := arms()
+		for i := range after {
+			if before == nil || after[i] == before[i] {
+				continue
+			}
+			if after[i] != step.changed && before[i] != step.changed {
+				t.Errorf("%v: Client %d moved from %v to %v", step.weights, i, before[i], after[i])
+				break
+			}
+		}
+		before = after
+	}
+}
+
+type SplitFilterCounter int
+
+func (c *SplitFilterCounter) FilterRequest(req *falcore.Request) *http.Response {
+	*c++
+	return nil
+}
@@ -0,0 +1,126 @@
+package router
+
+import (
+	"container/list"
+	"github.com/fitstar/falcore"
+	"regexp"
+	"strings"
+)
+
+// Will match a string exactly
+type ExactRoute struct {
+	Match  string
+	Filter falcore.RequestFilter
+}
+
+func (r *ExactRoute) MatchString(str string) falcore.RequestFilter {
+	if str == r.Match {
+		return r.Filter
+	}
+	return nil
+}
+
+// Will match strings starting with Prefix
+type PrefixRoute struct {
+	Prefix string
+	Filter falcore.RequestFilter
+}
+
+func (r *PrefixRoute) MatchString(str string) falcore.RequestFilter {
+	if strings.HasPrefix(str, r.Prefix) {
+		return r.Filter
+	}
+	return nil
+}
+
+// Route requests based on the value of a request header, like
+// Accept-Version.  Only the header's first value is used.  Routes are
+// tried in order and the first match wins.  A missing header is
+// matched as "", so a MatchAnyRoute at the end catches those too.
+type HeaderRouter struct {
+	Header string
+	valueRoutes
+}
+
+// Generate a new HeaderRouter instance for header
+func NewHeaderRouter(header string) *HeaderRouter {
+	return &HeaderRouter{Header: header, valueRoutes: valueRoutes{list.New()}}
+}
+
+// Will panic if r.Routes contains an object that isn't a Route
+func (r *HeaderRouter) SelectPipeline(req *falcore.Request) (pipe falcore.RequestFilter) {
+	return r.match(req.HttpRequest.Header.Get(r.Header))
+}
+
+// Route requests based on a query parameter, like HeaderRouter
+type QueryRouter struct {
+	Param string
+	valueRoutes
+}
+
+// Generate a new QueryRouter instance for param
+func NewQueryRouter(param string) *QueryRouter {
+	return &QueryRouter{Param: param, valueRoutes: valueRoutes{list.New()}}
+}
+
+// Will panic if r.Routes contains an object that isn't a Route
+func (r *QueryRouter) SelectPipeline(req *falcore.Request) (pipe falcore.RequestFilter) {
+	return r.match(req.HttpRequest.URL.Query().Get(r.Param))
+}
+
+// Route requests based on a cookie's value, like HeaderRouter
+type CookieRouter struct {
+	Cookie string
+	valueRoutes
+}
+
+// Generate a new CookieRouter instance for cookie
+func NewCookieRouter(cookie string) *CookieRouter {
+	return &CookieRouter{Cookie: cookie, valueRoutes: valueRoutes{list.New()}}
+}
+
+// Will panic if r.Routes contains an object that isn't a Route
+func (r *CookieRouter) SelectPipeline(req *falcore.Request) (pipe falcore.RequestFilter) {
+	var value string
+	if c, err := req.HttpRequest.Cookie(r.Cookie); err == nil {
+		value = c.Value
+	}
+	return r.match(value)
+}
+
+// The routes shared by the routers that match a value from the request
+type valueRoutes struct {
+	Routes *list.List
+}
+
+func (r *valueRoutes) AddRoute(route Route) {
+	r.Routes.PushBack(route)
+}
+
+// convenience method for adding RegexpRoutes
+func (r *valueRoutes) AddMatch(match string, filter falcore.RequestFilter) (err error) {
+	route := &RegexpRoute{Filter: filter}
+	if route.Match, err = regexp.Compile(match); err == nil {
+		r.Routes.PushBack(route)
+	}
+	return
+}
+
+// convenience method for adding ExactRoutes
+func (r *valueRoutes) AddExact(value string, filter falcore.RequestFilter) {
+	r.Routes.PushBack(&ExactRoute{value, filter})
+}
+
+// convenience method for adding PrefixRoutes
+func (r *valueRoutes) AddPrefix(prefix string, filter falcore.RequestFilter) {
+	r.Routes.PushBack(&PrefixRoute{prefix, filter})
+}
+
+func (r *valueRoutes) match(value string) falcore.RequestFilter {
+	for e := r.Routes.Front(); e != nil; e = e.Next() {
+		if f := e.Value.(Route).MatchString(value); f != nil {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package router
+
+import (
+	"github.com/fitstar/falcore"
+	"net/http"
+	"testing"
+)
+
+func TestValueRouters(t *testing.T) {
+	var v1, v2, beta, fallback SimpleFilter = 1, 2, 3, 4
+	routes := func(r interface {
+		AddExact(string, falcore.RequestFilter)
+		AddPrefix(string, falcore.RequestFilter)
+		AddMatch(string, falcore.RequestFilter) error
+		AddRoute(Route)
+	}) {
+		r.AddExact("1", v1)
+		r.AddPrefix("2.", v2)
+		if err := r.AddMatch(`^beta-\d+$`, beta); err != nil {
+			t.Fatal(err)
+		}
+		r.AddRoute(&MatchAnyRoute{fallback})
+	}
+	hr := NewHeaderRouter("Accept-Version")
+	routes(hr)
+	qr := NewQueryRouter("version")
+	routes(qr)
+	cr := NewCookieRouter("version")
+	routes(cr)
+
+	tests := []struct {
+		value    string
+		expected falcore.RequestFilter
+	}{
+		{"1", v1},
+		{"10", fallback},
+		{"2.3", v2},
+		{"beta-7", beta},
+		{"beta-x", fallback},
+		{"", fallback},
+	}
+	for _, test := range tests {
+		req := validGetRequest()
+		if test.value != "" {
+			req.HttpRequest.Header.Set("Accept-Version", test.value)
+			req.HttpRequest.URL.RawQuery = "version=" + test.value
+			req.HttpRequest.AddCookie(&http.Cookie{Name: "version", Value: test.value})
+		}
+		if filt := hr.SelectPipeline(req); filt != test.expected {
+			t.Errorf("Header %q: Expected %v, got %v", test.value, test.expected, filt)
+		}
+		if filt := qr.SelectPipeline(req); filt != test.expected {
+			t.Errorf("Query %q: Expected %v, got %v", test.value, test.expected, filt)
+		}
+		if filt := cr.SelectPipeline(req); filt != test.expected {
+			t.Errorf("Cookie %q: Expected %v, got %v", test.value, test.expected, filt)
+		}
+	}
+
+	// without a fallback, nothing matches
+	hr = NewHeaderRouter("X-Api-Key")
+	hr.AddPrefix("premium-", v1)
+	if filt := hr.SelectPipeline(validGetRequest()); filt != nil {
+		t.Errorf("Expected no match, got %v", filt)
+	}
+}
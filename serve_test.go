@@ -0,0 +1,160 @@
+package falcore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeMultipleListeners(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, fmt.Sprintf("%T", req.RemoteAddr))
+	}))
+	srv := NewServer(0, pipeline)
+
+	tcp, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "falcore.sock")
+	unix, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{}, 2)
+	for _, l := range []net.Listener{tcp, unix} {
+		go func(l net.Listener) {
+			srv.Serve(l)
+			done <- struct{}{}
+		}(l)
+	}
+	<-srv.AcceptReady
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		addr   string
+	}{
+		{"tcp", http.DefaultClient, "*net.TCPAddr"},
+		{"unix", &http.Client{Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", sock)
+			},
+		}}, "*net.UnixAddr"},
+	}
+	for _, test := range tests {
+		res, err := test.client.Get(fmt.Sprintf("http://%v/", tcp.Addr()))
+		if err != nil {
+			t.Errorf("%v: Couldn't get: %v", test.name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != test.addr {
+			t.Errorf("%v: Expected RemoteAddr type %v, got %s", test.name, test.addr, body)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve didn't return after Shutdown")
+		}
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "falcore.sock")
+	startTestServer(t, NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}), func(srv *Server) {
+		srv.Addr = "unix:" + sock
+	})
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.0\r\n\r\n")
+	if b, _ := ioutil.ReadAll(conn); len(b) == 0 {
+		t.Errorf("No response over unix socket")
+	}
+}
+
+func TestServeUnixAndListenAndServe(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	srv := NewServer(0, pipeline)
+	sock := filepath.Join(t.TempDir(), "falcore.sock")
+	unix, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		srv.Serve(unix)
+		done <- struct{}{}
+	}()
+	<-srv.AcceptReady
+	go func() {
+		srv.ListenAndServe()
+		done <- struct{}{}
+	}()
+	for i := 0; srv.Port() == 0; i++ {
+		if i == 100 {
+			t.Fatal("ListenAndServe didn't bind Addr")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	srv.connMutex.Lock()
+	accepting := srv.accepting
+	srv.connMutex.Unlock()
+	if accepting != 2 {
+		t.Errorf("Expected 2 accept loops, got %v", accepting)
+	}
+	for _, network := range []string{"unix", "tcp"} {
+		addr := sock
+		if network == "tcp" {
+			addr = fmt.Sprintf("localhost:%v", srv.Port())
+		}
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Errorf("%v: Couldn't connect: %v", network, err)
+			continue
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.0\r\n\r\n")
+		if b, _ := ioutil.ReadAll(conn); len(b) == 0 {
+			t.Errorf("%v: No response", network)
+		}
+		conn.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve didn't return after Shutdown")
+		}
+	}
+}
@@ -3,16 +3,17 @@ package falcore
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
-	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,28 +22,141 @@ import (
 )
 
 type Server struct {
+	// Address to listen on when no listeners have been added.  Either
+	// a TCP address like ":8080" or "unix:" followed by a socket path.
 	Addr               string
 	Pipeline           *Pipeline
 	CompletionCallback RequestCompletionCallback
-	listener           net.Listener
+	listeners          []*serverListener
 	stopAccepting      chan struct{}
+	stopOnce           *sync.Once
 	handlerWaitGroup   *sync.WaitGroup
+	connMutex          *sync.Mutex
+	connCond           *sync.Cond
+	conns              map[net.Conn]trackedConn
+	connsPerIP         map[string]int
+	peakConns          int
+	accepting          int
 	logPrefix          string
 	AcceptReady        chan struct{}
+	readyOnce          *sync.Once
 	bufferPool         *BufferPool
 	writeBufferPool    *WriteBufferPool
 	PanicHandler       func(conn net.Conn, err interface{})
+
+	// Maximum time to read a request's headers, measured from the
+	// first byte of the request.  Zero uses ReadTimeout.
+	ReadHeaderTimeout time.Duration
+	// Maximum time to read a whole request, headers and body, measured
+	// from the first byte of the request.  Zero means no limit.
+	ReadTimeout time.Duration
+	// Maximum time to write a response, measured from the end of the
+	// request headers.  Zero means no limit.
+	WriteTimeout time.Duration
+	// Maximum time to wait for the next request on a keep-alive
+	// connection.  Zero uses ReadTimeout.
+	IdleTimeout time.Duration
+
+	// Maximum number of open connections.  Zero means no limit.
+	MaxConnections int
+	// Maximum number of open connections from a single IP address.
+	// Zero means no limit.
+	MaxConnectionsPerIP int
+	// What to do when MaxConnections is reached.  By default the server
+	// stops accepting until a connection closes.  If RejectOverLimit is
+	// set, it keeps accepting but answers the extra connections with a
+	// 503 and closes them.  Connections over MaxConnectionsPerIP always
+	// get a 503.
+	RejectOverLimit bool
+
+	// Maximum size of a request's start line and headers.  Larger
+	// requests get a 431 and the connection is closed.  Zero uses
+	// DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+
+	// Networks of load balancers that start each connection with a
+	// PROXY protocol header, version 1 or 2.  Connections from these
+	// addresses must send one, and the client address in it becomes
+	// the Request's RemoteAddr.  Connections from elsewhere are served
+	// as usual.  The header is read before TLS, so give Serve a plain
+	// listener.  MaxConnectionsPerIP counts the balancer's address.
+	ProxyProtocolNetworks []*net.IPNet
+
+	// TLS settings for ListenAndServeTLS.  Set Certificates or
+	// GetCertificate (see CertStore) to serve several certificates, and
+	// ClientAuth and ClientCAs to ask clients for certificates.  The
+	// config is copied when the server starts.  Nil uses the defaults.
+	TLSConfig *tls.Config
+
+	// Offer HTTP/2 to TLS clients through ALPN.  Streams go through
+	// the Pipeline one Request each, as with ServeHTTP.  Requires Go
+	// 1.24 or later.
+	EnableHTTP2 bool
+	// Accept unencrypted HTTP/2 (h2c), from clients with prior
+	// knowledge and through HTTP/1.1 Upgrade.
+	EnableH2C bool
+	h2        *http2Server
+	h2Once    *sync.Once
 }
 
+// Used when Server.MaxHeaderBytes is zero
+const DefaultMaxHeaderBytes = 1 << 20 // 1 MB
+
 type RequestCompletionCallback func(req *Request, res *http.Response)
 
+// Tracks what a connection is doing so Shutdown knows which
+// connections can be closed right away.
+type connState int
+
+const (
+	connStateNew    connState = iota // accepted, waiting for the first request
+	connStateIdle                    // waiting for the next request
+	connStateActive                  // reading, executing or writing a request
+	connStateHTTP2                   // handed to the HTTP/2 server
+)
+
+type trackedConn struct {
+	state    connState
+	accepted time.Time
+}
+
+// How long Shutdown lets a new connection send its first request, like
+// net/http does
+var newConnGrace = 5 * time.Second
+
+// How often Shutdown checks for connections that have become idle
+var shutdownPollInterval = 100 * time.Millisecond
+
+// Returned by Shutdown when the context expires before all
+// connections have finished.  Aborted is the number of connections
+// that were forcibly closed.
+type ShutdownError struct {
+	Aborted int
+	Err     error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("falcore: shutdown aborted %d connections: %v", e.Aborted, e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
 func NewServer(port int, pipeline *Pipeline) *Server {
 	s := new(Server)
 	s.Addr = fmt.Sprintf(":%v", port)
 	s.Pipeline = pipeline
 	s.stopAccepting = make(chan struct{})
+	s.stopOnce = new(sync.Once)
 	s.AcceptReady = make(chan struct{})
+	s.readyOnce = new(sync.Once)
+	s.h2Once = new(sync.Once)
 	s.handlerWaitGroup = new(sync.WaitGroup)
+	s.connMutex = new(sync.Mutex)
+	s.connCond = sync.NewCond(s.connMutex)
+	s.conns = make(map[net.Conn]trackedConn)
+	s.connsPerIP = make(map[string]int)
 	s.logPrefix = fmt.Sprintf("%d", syscall.Getpid())
 
 	// buffer pool for reusing connection bufio.Readers
@@ -52,18 +166,28 @@ func NewServer(port int, pipeline *Pipeline) *Server {
 	return s
 }
 
+// Adds a listener for the already open socket fd.  May be called more
+// than once to serve on several sockets.  Any stream socket type is
+// supported.  fd is closed; the listener uses a duplicate.
 func (srv *Server) FdListen(fd int, name string) error {
-	var err error
-	if srv.listener, err = net.FileListener(os.NewFile(uintptr(fd), name)); err != nil {
+	l, err := net.FileListener(os.NewFile(uintptr(fd), name))
+	if err != nil {
 		return err
 	}
-	if _, ok := srv.listener.(*net.TCPListener); !ok {
-		return errors.New("Broken listener isn't TCP")
-	}
+	srv.addListener(l)
 	return syscall.Close(fd)
 }
 
 func (srv *Server) socketListen() error {
+	if strings.HasPrefix(srv.Addr, "unix:") {
+		l, err := net.Listen("unix", srv.Addr[len("unix:"):])
+		if err != nil {
+			return err
+		}
+		srv.addListener(l)
+		return nil
+	}
+
 	var la *net.TCPAddr
 	var err error
 	if la, err = net.ResolveTCPAddr("tcp", srv.Addr); err != nil {
@@ -74,20 +198,74 @@ func (srv *Server) socketListen() error {
 	if l, err = net.ListenTCP("tcp", la); err != nil {
 		return err
 	}
-	srv.listener = l
+	srv.addListener(l)
 	return nil
 }
 
+// A listening socket.  raw is the socket as it was bound or passed in,
+// which is what gets handed to a new process and given accept
+// deadlines.  l is what connections are accepted from: raw wrapped for
+// PROXY headers and TLS.  l is nil until the listener is served.
+type serverListener struct {
+	raw net.Listener
+	l   net.Listener
+}
+
+func (srv *Server) addListener(l net.Listener) {
+	srv.connMutex.Lock()
+	srv.listeners = append(srv.listeners, &serverListener{raw: l})
+	srv.connMutex.Unlock()
+}
+
+// A copy of the listener list, safe to use while Serve is adding to it
+func (srv *Server) currentListeners() []*serverListener {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	return append([]*serverListener(nil), srv.listeners...)
+}
+
+// Whether there are listeners from FdListen or SystemdListen that
+// aren't being served yet
+func (srv *Server) hasUnservedListeners() bool {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	for _, sl := range srv.listeners {
+		if sl.l == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Wraps the listeners that aren't being served yet with wrap and
+// counts their accept loops.  Returns them for serve.
+func (srv *Server) startListeners(wrap func(net.Listener) net.Listener) []*serverListener {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	var started []*serverListener
+	for _, sl := range srv.listeners {
+		if sl.l == nil {
+			sl.l = wrap(sl.raw)
+			started = append(started, sl)
+		}
+	}
+	srv.accepting += len(started)
+	return started
+}
+
+// Serves on the listeners added with FdListen or SystemdListen, or
+// binds Addr if there aren't any.  Listeners already being served by
+// Serve are left to it, so a Unix socket can be served alongside Addr.
 func (srv *Server) ListenAndServe() error {
 	if srv.Addr == "" {
 		srv.Addr = ":http"
 	}
-	if srv.listener == nil {
+	if !srv.hasUnservedListeners() {
 		if err := srv.socketListen(); err != nil {
 			return err
 		}
 	}
-	return srv.serve()
+	return srv.serve(srv.startListeners(srv.proxyListener))
 }
 
 func fcntl(fd int, cmd int, arg int) {
@@ -98,47 +276,316 @@ func noCloseOnExec(fd int) {
 	fcntl(fd, syscall.F_SETFD, ^syscall.FD_CLOEXEC)
 }
 
+// Returns duplicates of the listening sockets as *os.Files, in the
+// order they were added.  The caller is responsible for closing them.
+// Used by the restart package to hand the sockets to a new process.
+// Since another process may end up serving them, Unix sockets handed
+// out this way are no longer removed when the server shuts down.
+func (srv *Server) ListenerFiles() ([]*os.File, error) {
+	listeners := srv.currentListeners()
+	files := make([]*os.File, 0, len(listeners))
+	for _, sl := range listeners {
+		f, err := listenerFile(sl.raw)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	for _, sl := range listeners {
+		if ul, ok := sl.raw.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return files, nil
+}
+
+// Duplicates the listener's descriptor by hand rather than with its
+// File method.  Those files switch the shared socket to blocking mode
+// when exec.Cmd asks for their descriptors, which would leave our
+// accept loops stuck in accept(2) where Close can't reach them.
+func listenerFile(l net.Listener) (*os.File, error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("falcore: can't get file for listener %T", l)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	fd := -1
+	cerr := rc.Control(func(sysfd uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, err = syscall.Dup(int(sysfd)); err == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("dup", err)
+	}
+	return os.NewFile(uintptr(fd), l.Addr().Network()+":"+l.Addr().String()), nil
+}
+
+// Returns a duplicate of the first listening socket's file descriptor
+// with close-on-exec cleared, along with a name suitable for FdListen.
+// Returns -1 if the descriptor can't be duplicated.
+//
+// Deprecated: use the restart package, or ListenerFiles and exec.Cmd.ExtraFiles.
 func (srv *Server) SocketFd() (int, string) {
-	fd := int(reflect.ValueOf(srv.listener).Elem().FieldByName("fd").Elem().FieldByName("sysfd").Int())
-	noCloseOnExec(fd)
-	return fd, fmt.Sprintf("tcp:%s->", srv.listener.Addr())
+	listeners := srv.currentListeners()
+	if len(listeners) == 0 {
+		return -1, ""
+	}
+	f, err := listenerFile(listeners[0].raw)
+	if err != nil {
+		return -1, ""
+	}
+	defer f.Close()
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return -1, ""
+	}
+	fd := -1
+	rc.Control(func(sysfd uintptr) {
+		if fd, err = syscall.Dup(int(sysfd)); err != nil {
+			fd = -1
+		}
+	})
+	if fd != -1 {
+		noCloseOnExec(fd)
+	}
+	return fd, fmt.Sprintf("tcp:%s->", listeners[0].raw.Addr())
 }
 
+// Serve TLS using srv.TLSConfig.  The key pair in certFile and keyFile
+// is added to the config's certificates, ahead of any already there.
+// Both may be empty if the config has its own certificates.
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	if srv.Addr == "" {
 		srv.Addr = ":https"
 	}
-	config := &tls.Config{
-		Rand:       rand.Reader,
-		Time:       time.Now,
-		NextProtos: []string{"http/1.1"},
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	if config.Rand == nil {
+		config.Rand = rand.Reader
+	}
+	if config.Time == nil {
+		config.Time = time.Now
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = srv.tlsNextProtos()
 	}
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = append([]tls.Certificate{cert}, config.Certificates...)
+	} else if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return errors.New("falcore: ListenAndServeTLS needs a certificate")
 	}
 
-	if srv.listener == nil {
+	if !srv.hasUnservedListeners() {
 		if err := srv.socketListen(); err != nil {
 			return err
 		}
 	}
 
-	srv.listener = tls.NewListener(srv.listener, config)
-
-	return srv.serve()
+	return srv.serve(srv.startListeners(func(l net.Listener) net.Listener {
+		return tls.NewListener(srv.proxyListener(l), config)
+	}))
 }
 
+// Stop accepting new connections.  Open connections are closed after
+// their current request.  Safe to call more than once.
 func (srv *Server) StopAccepting() {
-	close(srv.stopAccepting)
+	srv.stopOnce.Do(func() {
+		srv.connMutex.Lock()
+		close(srv.stopAccepting)
+		// wake accept loops waiting for a free connection slot
+		srv.connCond.Broadcast()
+		srv.connMutex.Unlock()
+	})
+}
+
+func (srv *Server) stopping() bool {
+	select {
+	case <-srv.stopAccepting:
+		return true
+	default:
+		return false
+	}
+}
+
+// Gracefully shut down the server.  Shutdown stops accepting new
+// connections, closes idle keep-alive connections immediately and
+// waits for in-flight requests to finish.  Connections that haven't
+// sent their first request yet, including TLS connections in the
+// handshake, get 5 seconds from when they were accepted to send it.  If ctx expires first, the
+// remaining connections are closed and a *ShutdownError reporting how
+// many were aborted is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.StopAccepting()
+	for _, sl := range srv.currentListeners() {
+		sl.raw.Close()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return &ShutdownError{Aborted: srv.closeAllConns(), Err: ctx.Err()}
+		case <-ticker.C:
+		}
+	}
+}
+
+// Closes all idle connections, and new ones that have had their
+// chance to send a request.  Returns the number of connections
+// and accept loops still running.
+func (srv *Server) closeIdleConns() int {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	for c, tc := range srv.conns {
+		if tc.state == connStateIdle || tc.state == connStateNew && time.Since(tc.accepted) > newConnGrace {
+			c.Close()
+			srv.removeConnLocked(c)
+		}
+	}
+	return len(srv.conns) + srv.accepting
+}
+
+// Closes all tracked connections.  Returns the number closed.
+func (srv *Server) closeAllConns() int {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	n := len(srv.conns)
+	for c := range srv.conns {
+		c.Close()
+		srv.removeConnLocked(c)
+	}
+	return n
+}
+
+// Starts tracking a newly accepted connection.  Returns false, without
+// tracking it, if the connection would go over one of the limits.
+// Unless RejectOverLimit is set, it waits for room under
+// MaxConnections instead.
+func (srv *Server) trackConn(c net.Conn) bool {
+	ip := connIP(c)
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	if srv.MaxConnections > 0 && !srv.RejectOverLimit {
+		// The accept loop of another listener may have taken the room
+		// waitForConnSlot saw.  Checking and tracking under one lock
+		// holds it for this connection.
+		for len(srv.conns) >= srv.MaxConnections && !srv.stopping() {
+			srv.connCond.Wait()
+		}
+	}
+	if srv.MaxConnections > 0 && len(srv.conns) >= srv.MaxConnections {
+		return false
+	}
+	if srv.MaxConnectionsPerIP > 0 && ip != "" && srv.connsPerIP[ip] >= srv.MaxConnectionsPerIP {
+		return false
+	}
+	srv.conns[c] = trackedConn{state: connStateNew, accepted: time.Now()}
+	if ip != "" {
+		srv.connsPerIP[ip]++
+	}
+	if len(srv.conns) > srv.peakConns {
+		srv.peakConns = len(srv.conns)
+	}
+	return true
+}
+
+// Updates the state of a tracked connection.  Connections already
+// closed by Shutdown are not re-added.
+func (srv *Server) setConnState(c net.Conn, state connState) {
+	srv.connMutex.Lock()
+	if tc, ok := srv.conns[c]; ok {
+		tc.state = state
+		srv.conns[c] = tc
+	}
+	srv.connMutex.Unlock()
 }
 
+func (srv *Server) untrackConn(c net.Conn) {
+	srv.connMutex.Lock()
+	srv.removeConnLocked(c)
+	srv.connMutex.Unlock()
+}
+
+// Must be called with connMutex held
+func (srv *Server) removeConnLocked(c net.Conn) {
+	if _, ok := srv.conns[c]; !ok {
+		return
+	}
+	delete(srv.conns, c)
+	if ip := connIP(c); ip != "" {
+		if srv.connsPerIP[ip] <= 1 {
+			delete(srv.connsPerIP, ip)
+		} else {
+			srv.connsPerIP[ip]--
+		}
+	}
+	srv.connCond.Broadcast()
+}
+
+// Blocks until the server has room for another connection or is
+// stopping, so connections over the limit wait in the listen backlog.
+// Only used when new connections shouldn't be rejected.
+func (srv *Server) waitForConnSlot() {
+	if srv.MaxConnections <= 0 || srv.RejectOverLimit {
+		return
+	}
+	srv.connMutex.Lock()
+	for len(srv.conns) >= srv.MaxConnections && !srv.stopping() {
+		srv.connCond.Wait()
+	}
+	srv.connMutex.Unlock()
+}
+
+// The number of currently open connections
+func (srv *Server) Connections() int {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	return len(srv.conns)
+}
+
+// The highest number of connections that have been open at once
+func (srv *Server) PeakConnections() int {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	return srv.peakConns
+}
+
+// The IP address a connection is from, or "" if it isn't an IP
+// connection
+func connIP(c net.Conn) string {
+	if addr, ok := directRemoteAddr(c).(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// The port of the first listener that has one
 func (srv *Server) Port() int {
-	if l := srv.listener; l != nil {
-		a := l.Addr()
+	for _, sl := range srv.currentListeners() {
+		a := sl.raw.Addr()
 		if _, p, e := net.SplitHostPort(a.String()); e == nil && p != "" {
 			server_port, _ := strconv.Atoi(p)
 			return server_port
@@ -147,16 +594,79 @@ func (srv *Server) Port() int {
 	return 0
 }
 
-func (srv *Server) serve() (e error) {
-	close(srv.AcceptReady)
+// Runs an accept loop for each of listeners, which startListeners
+// has counted, and waits for them all to stop, then for the handlers
+// to finish.
+func (srv *Server) serve(listeners []*serverListener) error {
+	srv.readyOnce.Do(func() { close(srv.AcceptReady) })
+
+	accepters := new(sync.WaitGroup)
+	for _, sl := range listeners {
+		accepters.Add(1)
+		go func(sl *serverListener) {
+			srv.acceptLoop(sl)
+			accepters.Done()
+		}(sl)
+	}
+	accepters.Wait()
+	Trace("Stopped accepting, waiting for handlers")
+	// wait for handlers
+	srv.handlerWaitGroup.Wait()
+	return nil
+}
+
+// Serves connections accepted from l until StopAccepting or Shutdown
+// is called.  Serve may be called for several listeners at once, for
+// example a Unix socket for local clients alongside a public TCP
+// socket.  They all share the Pipeline, connection handling and
+// shutdown.  Serve returns once l has stopped accepting and all of the
+// server's connections have finished.
+func (srv *Server) Serve(l net.Listener) error {
+	sl := &serverListener{raw: l, l: srv.proxyListener(l)}
+	srv.connMutex.Lock()
+	srv.listeners = append(srv.listeners, sl)
+	srv.accepting++
+	srv.connMutex.Unlock()
+	srv.readyOnce.Do(func() { close(srv.AcceptReady) })
+
+	srv.acceptLoop(sl)
+	srv.handlerWaitGroup.Wait()
+	return nil
+}
+
+// Accepts connections from sl until the server stops accepting.  The
+// caller must have counted this loop in srv.accepting.
+func (srv *Server) acceptLoop(sl *serverListener) {
+	l := sl.l
+	defer func() {
+		srv.connMutex.Lock()
+		srv.accepting--
+		srv.connMutex.Unlock()
+	}()
+	if srv.stopping() {
+		l.Close()
+		return
+	}
 accept:
 	for {
 		var c net.Conn
-		if l, ok := srv.listener.(*net.TCPListener); ok {
-			l.SetDeadline(time.Now().Add(3 * time.Second))
+		var e error
+		srv.waitForConnSlot()
+		// The wrappers for TLS and PROXY headers don't have SetDeadline,
+		// but their Accept returns when the socket's does
+		if dl, ok := sl.raw.(interface {
+			SetDeadline(time.Time) error
+		}); ok {
+			dl.SetDeadline(time.Now().Add(3 * time.Second))
 		}
-		c, e = srv.listener.Accept()
+		c, e = l.Accept()
 		if e != nil {
+			select {
+			case <-srv.stopAccepting:
+				// listener was closed by Shutdown
+				break accept
+			default:
+			}
 			if ope, ok := e.(*net.OpError); ok {
 				if !(ope.Timeout() && ope.Temporary()) {
 					Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), ope)
@@ -168,7 +678,11 @@ accept:
 		} else {
 			//Trace("Handling!")
 			srv.handlerWaitGroup.Add(1)
-			go srv.handler(c)
+			if srv.trackConn(c) {
+				go srv.handler(c)
+			} else {
+				go srv.rejectConn(c)
+			}
 		}
 		select {
 		case <-srv.stopAccepting:
@@ -176,16 +690,17 @@ accept:
 		default:
 		}
 	}
-	Trace("Stopped accepting, waiting for handlers")
-	// wait for handlers
-	srv.handlerWaitGroup.Wait()
-	return nil
 }
 
 func (srv *Server) sentinel(c net.Conn, connClosed chan struct{}) {
 	select {
 	case <-srv.stopAccepting:
-		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		// HTTP/2 connections are shut down with GOAWAY instead
+		srv.connMutex.Lock()
+		if srv.conns[c].state != connStateHTTP2 {
+			c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		}
+		srv.connMutex.Unlock()
 	case <-connClosed:
 	}
 }
@@ -194,16 +709,47 @@ func (srv *Server) sentinel(c net.Conn, connClosed chan struct{}) {
 // If you are using falcore.Server as a net/http.Handler, you should
 // not call any of the Listen methods
 func (srv *Server) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	srv.serveHTTP(wr, req, nil)
+}
+
+// Runs a request from a net/http.Server through the pipeline.  c is
+// the connection it came on, if known.
+func (srv *Server) serveHTTP(wr http.ResponseWriter, req *http.Request, c net.Conn) {
 	// We can't get the connection in this case.
 	// Need to be really careful about how we use this property elsewhere.
 	request := NewRequest(req, nil, time.Now())
+	if c != nil {
+		// net/http answers 100-continue itself, so the connection is
+		// only set afterwards, for ProxyHeader
+		request.connection = c
+		request.RemoteAddr = c.RemoteAddr()
+		request.ClientIP = addrIP(request.RemoteAddr)
+	}
+	if hj, ok := wr.(http.Hijacker); ok {
+		request.hijacker = hj.Hijack
+	}
 	res := srv.handlerExecutePipeline(request, false)
+	if res == nil {
+		// hijacked
+		request.finishRequest()
+		srv.requestFinished(request, hijackedResponse(req))
+		return
+	}
+	if request.bodyTooLarge && res.StatusCode != 413 {
+		if res.Body != nil {
+			res.Body.Close()
+		}
+		res = bodyTooLargeResponse(req)
+	}
 
 	// Copy headers
 	theHeader := wr.Header()
 	for key, header := range res.Header {
 		theHeader[key] = header
 	}
+	for key := range res.Trailer {
+		theHeader.Add("Trailer", key)
+	}
 
 	// Write headers
 	wr.WriteHeader(res.StatusCode)
@@ -212,7 +758,14 @@ func (srv *Server) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	request.startPipelineStage("server.ResponseWrite")
 	if res.Body != nil {
 		defer res.Body.Close()
-		io.Copy(wr, res.Body)
+		body := io.Reader(res.Body)
+		if f, ok := wr.(http.Flusher); ok {
+			body = newFlushBeforeRead(res.Body, func() error { f.Flush(); return nil })
+		}
+		io.Copy(wr, body)
+	}
+	for key, trailer := range res.Trailer {
+		theHeader[key] = trailer
 	}
 	request.finishPipelineStage()
 	request.finishRequest()
@@ -222,23 +775,73 @@ func (srv *Server) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 
 func (srv *Server) handler(c net.Conn) {
 	var startTime time.Time
-	bpe := srv.bufferPool.Take(c)
-	defer srv.bufferPool.Give(bpe)
+	// caps how much header the bufio.Reader may pull off the connection
+	lr := &io.LimitedReader{R: c}
+	bpe := srv.bufferPool.Take(lr)
 	wbpe := srv.writeBufferPool.Take(c)
-	defer srv.writeBufferPool.Give(wbpe)
+	hijacked := false
+	defer func() {
+		// a hijacked connection keeps its buffers
+		if !hijacked {
+			srv.bufferPool.Give(bpe)
+			srv.writeBufferPool.Give(wbpe)
+		}
+	}()
 	closeSentinelChan := make(chan struct{})
 	go srv.sentinel(c, closeSentinelChan)
-	defer srv.connectionFinished(c, closeSentinelChan)
+	defer srv.connectionFinished(c, closeSentinelChan, &hijacked)
+	if err := srv.readProxyHeader(c); err != nil {
+		srv.logReadError(c, err)
+		return
+	}
+	if srv.serveNegotiatedHTTP2(c) {
+		return
+	}
 	var err error
 	var req *http.Request
 	// no keepalive (for now)
 	reqCount := 0
 	keepAlive := true
 	for err == nil && keepAlive {
-		if _, err := bpe.Br.Peek(1); err == nil {
-			startTime = time.Now()
+		if reqCount > 0 {
+			srv.setConnState(c, connStateIdle)
+		}
+		srv.setReadDeadline(c, time.Now(), srv.idleTimeout())
+		lr.N = srv.headerReadLimit()
+		if _, err = bpe.Br.Peek(1); err != nil {
+			// Closed or idle too long.  Nobody to send a response to.
+			if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+				srv.logReadError(c, err)
+			}
+			break
 		}
+		if reqCount == 0 && srv.isH2CPreface(bpe.Br) {
+			lr.N = math.MaxInt64
+			srv.serveHTTP2(c, &bufferedConn{c, bpe.Br})
+			return
+		}
+		startTime = time.Now()
+		srv.setConnState(c, connStateActive)
+		srv.setReadDeadline(c, startTime, srv.readHeaderTimeout())
 		if req, err = http.ReadRequest(bpe.Br); err == nil {
+			lr.N = math.MaxInt64
+			srv.setReadDeadline(c, startTime, srv.ReadTimeout)
+			if srv.WriteTimeout > 0 {
+				c.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+			}
+			if reqCount == 0 {
+				if h2c, upgraded := srv.upgradeH2C(c, req, bpe.Br, wbpe.Br); upgraded {
+					if h2c != nil {
+						srv.serveHTTP2(c, h2c)
+					}
+					return
+				}
+			}
+			var body *timeoutReadCloser
+			if srv.ReadTimeout > 0 {
+				body = &timeoutReadCloser{ReadCloser: req.Body}
+				req.Body = body
+			}
 			if req.ProtoAtLeast(1, 1) {
 				if req.Header.Get("Connection") == "close" {
 					keepAlive = false
@@ -247,6 +850,9 @@ func (srv *Server) handler(c net.Conn) {
 				keepAlive = false
 			}
 			request := NewRequest(req, c, startTime)
+			request.hijacker = func() (net.Conn, *bufio.ReadWriter, error) {
+				return srv.hijackConn(c, bpe, wbpe)
+			}
 			reqCount++
 
 			pssInit := new(PipelineStageStat)
@@ -258,6 +864,28 @@ func (srv *Server) handler(c net.Conn) {
 
 			// execute the pipeline
 			var res = srv.handlerExecutePipeline(request, keepAlive)
+			if res == nil {
+				// a filter took over the connection
+				hijacked = true
+				request.finishRequest()
+				srv.requestFinished(request, hijackedResponse(req))
+				break
+			}
+
+			// the body took too long to arrive.  whatever the pipeline
+			// made of the partial body, the client gets a 408.
+			if body != nil && body.timedOut {
+				if res.Body != nil {
+					res.Body.Close()
+				}
+				res = StringResponse(req, 408, nil, "Request Timeout\n")
+				res.Close = true
+			} else if request.bodyTooLarge && res.StatusCode != 413 {
+				if res.Body != nil {
+					res.Body.Close()
+				}
+				res = bodyTooLargeResponse(req)
+			}
 
 			// shutting down?
 			select {
@@ -273,11 +901,13 @@ func (srv *Server) handler(c net.Conn) {
 			if res.Close {
 				keepAlive = false
 			}
+		} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			// part of a request arrived, but not in time
+			srv.handlerWriteTimeout(c, wbpe.Br)
+		} else if lr.N <= 0 {
+			srv.handlerWriteHeaderTooLarge(c, wbpe.Br)
 		} else {
-			// EOF is socket closed
-			if nerr, ok := err.(net.Error); err != io.EOF && !(ok && nerr.Timeout()) {
-				Error("%s %v ERROR reading request: <%T %v>", srv.serverLogPrefix(), c.RemoteAddr(), err, err)
-			}
+			srv.logReadError(c, err)
 		}
 	}
 	//Debug("%s Processed %v requests on connection %v", srv.serverLogPrefix(), reqCount, c.RemoteAddr())
@@ -287,8 +917,16 @@ func (srv *Server) handlerExecutePipeline(request *Request, keepAlive bool) *htt
 
 	var res *http.Response
 	// execute the pipeline
-	if res = srv.Pipeline.execute(request); res == nil {
-		res = StringResponse(request.HttpRequest, 404, nil, "Not Found")
+	res = srv.Pipeline.execute(request)
+	if request.hijacked {
+		// nothing more to do on this connection
+		if res != nil && res.Body != nil {
+			res.Body.Close()
+		}
+		return nil
+	}
+	if res == nil {
+		res = srv.Pipeline.notFound(request)
 	}
 
 	// The res.Write omits Content-length on 0 length bodies, and by spec,
@@ -323,6 +961,10 @@ func (srv *Server) handlerExecutePipeline(request *Request, keepAlive bool) *htt
 			res.TransferEncoding = []string{"identity"}
 		}
 	}
+	// Trailers can only follow a chunked body
+	if len(res.Trailer) > 0 && request.HttpRequest.Method != "HEAD" {
+		res.ContentLength = -1
+	}
 	if res.ContentLength < 0 && request.HttpRequest.Method != "HEAD" {
 		res.TransferEncoding = []string{"chunked"}
 	}
@@ -342,7 +984,13 @@ func (srv *Server) handlerWriteResponse(request *Request, res *http.Response, c
 	request.startPipelineStage("server.ResponseWrite")
 	request.CurrentStage.Type = PipelineStageTypeOverhead
 
-	var nodelay = srv.setNoDelay(c, false)
+	// streamed bodies go out piece by piece, so don't cork them
+	var nodelay bool
+	if _, ok := res.Body.(Flusher); ok {
+		res.Body = newFlushBeforeRead(res.Body, bw.Flush)
+	} else {
+		nodelay = srv.setNoDelay(c, false)
+	}
 	if nodelay {
 		res.Write(bw)
 		bw.Flush()
@@ -359,6 +1007,116 @@ func (srv *Server) handlerWriteResponse(request *Request, res *http.Response, c
 	srv.requestFinished(request, res)
 }
 
+func (srv *Server) logReadError(c net.Conn, err error) {
+	// EOF is socket closed.  Shutdown closes idle connections out from under us.
+	if err != io.EOF && !srv.stopping() {
+		Error("%s %v ERROR reading request: <%T %v>", srv.serverLogPrefix(), c.RemoteAddr(), err, err)
+	}
+}
+
+// How long to wait for a rejected client to read its 503
+const rejectLingerTimeout = 500 * time.Millisecond
+
+// Answers a connection over the connection limits with a 503 and
+// closes it.
+func (srv *Server) rejectConn(c net.Conn) {
+	defer srv.handlerWaitGroup.Done()
+	defer c.Close()
+	wbpe := srv.writeBufferPool.Take(c)
+	defer srv.writeBufferPool.Give(wbpe)
+
+	res := StringResponse(nil, 503, nil, "Service Unavailable\n")
+	res.Close = true
+	c.SetWriteDeadline(time.Now().Add(timeoutResponseWriteTimeout))
+	if res.Write(wbpe.Br) != nil || wbpe.Br.Flush() != nil {
+		return
+	}
+
+	// Closing with an unread request pending resets the connection,
+	// which can discard the response before the client sees it.  Let
+	// the client finish sending first.
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	c.SetReadDeadline(time.Now().Add(rejectLingerTimeout))
+	io.Copy(ioutil.Discard, c)
+}
+
+// Answers a request whose headers didn't arrive in time.  The
+// connection is closed afterward.
+func (srv *Server) handlerWriteTimeout(c net.Conn, bw *bufio.Writer) {
+	res := StringResponse(nil, 408, nil, "Request Timeout\n")
+	res.Close = true
+	c.SetWriteDeadline(time.Now().Add(timeoutResponseWriteTimeout))
+	res.Write(bw)
+	bw.Flush()
+}
+
+// How long to spend trying to send a 408 response
+const timeoutResponseWriteTimeout = time.Second
+
+// Answers a request whose headers are over MaxHeaderBytes.  The
+// connection is closed afterward.
+func (srv *Server) handlerWriteHeaderTooLarge(c net.Conn, bw *bufio.Writer) {
+	res := StringResponse(nil, 431, nil, "Request Header Fields Too Large\n")
+	res.Close = true
+	c.SetWriteDeadline(time.Now().Add(timeoutResponseWriteTimeout))
+	res.Write(bw)
+	bw.Flush()
+}
+
+// How much may be read from the connection for the next request's
+// headers.  Includes some slack for bytes the bufio.Reader reads ahead.
+func (srv *Server) headerReadLimit() int64 {
+	max := srv.MaxHeaderBytes
+	if max <= 0 {
+		max = DefaultMaxHeaderBytes
+	}
+	return int64(max) + 4096
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout > 0 {
+		return srv.IdleTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) readHeaderTimeout() time.Duration {
+	if srv.ReadHeaderTimeout > 0 {
+		return srv.ReadHeaderTimeout
+	}
+	return srv.ReadTimeout
+}
+
+// Sets the read deadline to timeout after start.  When none of the read
+// timeouts are used, deadlines are left alone so they don't interfere
+// with the shutdown sentinel.
+func (srv *Server) setReadDeadline(c net.Conn, start time.Time, timeout time.Duration) {
+	if srv.ReadTimeout == 0 && srv.ReadHeaderTimeout == 0 && srv.IdleTimeout == 0 {
+		return
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = start.Add(timeout)
+	}
+	c.SetReadDeadline(deadline)
+}
+
+// Remembers whether reading the request body ran into the read deadline
+type timeoutReadCloser struct {
+	io.ReadCloser
+	timedOut bool
+}
+
+func (b *timeoutReadCloser) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		b.timedOut = true
+	}
+	return n, err
+}
+
 func (srv *Server) serverLogPrefix() string {
 	return srv.logPrefix
 }
@@ -370,17 +1128,31 @@ func (srv *Server) requestFinished(request *Request, res *http.Response) {
 	}
 }
 
-func (srv *Server) connectionFinished(c net.Conn, closeChan chan struct{}) {
+func (srv *Server) connectionFinished(c net.Conn, closeChan chan struct{}, hijacked *bool) {
 	if srv.PanicHandler != nil {
 		if err := recover(); err != nil {
 			srv.PanicHandler(c, err)
 		}
 	}
-	c.Close()
+	srv.untrackConn(c)
+	if !*hijacked {
+		c.Close()
+	}
 	close(closeChan)
 	srv.handlerWaitGroup.Done()
 }
 
+// A connection whose reads come from r, which holds data already read
+// from the connection followed by the rest of it
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
 type lengthFixReadCloser struct {
 	io.Reader
 	io.Closer
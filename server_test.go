@@ -0,0 +1,42 @@
+package falcore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Starts a Server on a free port, with filter, if not nil, in its
+// Pipeline.  setup, if not nil, can change the server before it starts;
+// if it sets TLSConfig, the server serves TLS.  The server is shut down
+// when the test finishes.  internal/falcoretest does the same for the
+// tests of other packages.
+func startTestServer(t *testing.T, filter RequestFilter, setup func(srv *Server)) *Server {
+	pipeline := NewPipeline()
+	if filter != nil {
+		pipeline.Upstream.PushBack(filter)
+	}
+	srv := NewServer(0, pipeline)
+	if setup != nil {
+		setup(srv)
+	}
+	failed := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			failed <- srv.ListenAndServeTLS("", "")
+		} else {
+			failed <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case <-srv.AcceptReady:
+	case err := <-failed:
+		t.Fatalf("Couldn't start server: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		srv.Shutdown(ctx)
+		cancel()
+	})
+	return srv
+}
@@ -0,0 +1,155 @@
+package falcore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	srv := NewServer(0, pipeline)
+	served := make(chan error)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	<-srv.AcceptReady
+
+	// Leave a keep-alive connection sitting idle
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+	res.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown took too long with only idle connections: %v", d)
+	}
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe didn't return after Shutdown")
+	}
+}
+
+func TestShutdownWaitsForInFlight(t *testing.T) {
+	started := make(chan struct{})
+	srv := startTestServer(t, NewRequestFilter(func(req *Request) *http.Response {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}), nil)
+
+	resc := make(chan *http.Response, 1)
+	go func() {
+		res, _ := http.Get(fmt.Sprintf("http://localhost:%v/", srv.Port()))
+		resc <- res
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if res := <-resc; res == nil || res.StatusCode != 200 {
+		t.Errorf("In-flight request didn't complete: %v", res)
+	}
+}
+
+func TestShutdownAbortsOnTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := startTestServer(t, NewRequestFilter(func(req *Request) *http.Response {
+		close(started)
+		<-release
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}), nil)
+
+	go http.Get(fmt.Sprintf("http://localhost:%v/", srv.Port()))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	serr, ok := err.(*ShutdownError)
+	if !ok {
+		t.Fatalf("Expected a *ShutdownError, got %v", err)
+	}
+	if serr.Aborted != 1 {
+		t.Errorf("Expected 1 aborted connection, got %v", serr.Aborted)
+	}
+	if serr.Err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", serr.Err)
+	}
+}
+
+// A connection accepted before Shutdown still gets to send its first
+// request, also when it's in the TLS handshake
+func TestShutdownWaitsForNewConnections(t *testing.T) {
+	for _, useTLS := range []bool{false, true} {
+		var config *tls.Config
+		if useTLS {
+			config = testTLSConfig(t)
+		}
+		srv := startTestServer(t, okFilter, func(srv *Server) {
+			srv.TLSConfig = config
+		})
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+		if err != nil {
+			t.Fatalf("Couldn't connect: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; srv.Connections() == 0 && i < 100; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			done <- srv.Shutdown(ctx)
+		}()
+		time.Sleep(2 * shutdownPollInterval)
+
+		if useTLS {
+			conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("TLS %v: Couldn't read response: %v", useTLS, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 || !res.Close {
+			t.Errorf("TLS %v: Expected a 200 closing the connection, got %v %v", useTLS, res.StatusCode, res.Header)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("TLS %v: Shutdown returned error: %v", useTLS, err)
+		}
+	}
+}
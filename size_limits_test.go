@@ -0,0 +1,108 @@
+package falcore
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Reads the whole body and echoes its size and the limit
+var bodySizeFilter = NewRequestFilter(func(req *Request) *http.Response {
+	body, err := ioutil.ReadAll(req.HttpRequest.Body)
+	if err != nil {
+		return StringResponse(req.HttpRequest, 400, nil, err.Error())
+	}
+	return StringResponse(req.HttpRequest, 200, nil, fmt.Sprintf("%d %d", len(body), req.MaxBodyBytes()))
+})
+
+func readLimitResponse(t *testing.T, br *bufio.Reader) (*http.Response, string) {
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	srv := startTestServer(t, bodySizeFilter, func(srv *Server) {
+		srv.MaxHeaderBytes = 1024
+	})
+
+	conn, br := dialServer(t, srv)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Small: %s\r\n\r\n", strings.Repeat("a", 512))
+	if res, _ := readLimitResponse(t, br); res.StatusCode != 200 {
+		t.Fatalf("Expected 200 for small headers, got %v", res.StatusCode)
+	}
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: %s\r\n\r\n", strings.Repeat("a", 16<<10))
+	res, _ := readLimitResponse(t, br)
+	if res.StatusCode != 431 {
+		t.Errorf("Expected 431 for large headers, got %v", res.StatusCode)
+	}
+	if !res.Close {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestMaxBodyBytesContentLength(t *testing.T) {
+	srv := startTestServer(t, bodySizeFilter, func(srv *Server) {
+		srv.Pipeline.MaxBodyBytes = 10
+	})
+
+	conn, br := dialServer(t, srv)
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	if res, body := readLimitResponse(t, br); res.StatusCode != 200 || body != "5 10" {
+		t.Fatalf("Expected 200 \"5 10\", got %v %q", res.StatusCode, body)
+	}
+
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world")
+	res, _ := readLimitResponse(t, br)
+	if res.StatusCode != 413 {
+		t.Errorf("Expected 413, got %v", res.StatusCode)
+	}
+	if !res.Close {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestMaxBodyBytesChunked(t *testing.T) {
+	srv := startTestServer(t, bodySizeFilter, func(srv *Server) {
+		srv.Pipeline.MaxBodyBytes = 10
+	})
+
+	conn, br := dialServer(t, srv)
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n")
+	res, _ := readLimitResponse(t, br)
+	if res.StatusCode != 413 {
+		t.Errorf("Expected 413, got %v", res.StatusCode)
+	}
+	if !res.Close {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestMaxBodyBytesNested(t *testing.T) {
+	inner := NewPipeline()
+	inner.MaxBodyBytes = 5
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	outer := NewPipeline()
+	outer.MaxBodyBytes = 100
+	outer.Upstream.PushBack(inner)
+
+	tmp, _ := http.NewRequest("POST", "/", strings.NewReader("hello world"))
+	req, res := TestWithRequest(tmp, outer, nil)
+	if res.StatusCode != 413 {
+		t.Errorf("Expected 413 from the inner limit, got %v", res.StatusCode)
+	}
+	if req.MaxBodyBytes() != 5 {
+		t.Errorf("Expected an effective limit of 5, got %v", req.MaxBodyBytes())
+	}
+}
@@ -0,0 +1,115 @@
+package falcore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// One server-sent event.  Empty fields are left out.  Data may span
+// several lines.
+type SSEEvent struct {
+	ID    string
+	Event string
+	Retry time.Duration
+	Data  string
+}
+
+// Writes events to the body of a response made by SSEResponse.  Each
+// event is sent to the client as soon as it is written.  Safe to use
+// from one goroutine at a time; write from a goroutine other than the
+// filter's so the response can be returned first.
+//
+// Writes fail once the client goes away.  Close ends the stream.
+type SSEWriter struct {
+	w           *StreamWriter
+	lastEventID string
+}
+
+// Generate a streaming text/event-stream response and a writer for its
+// events.  The events are sent with chunked encoding, each one flushed
+// through the connection's write buffer as soon as it's written.  Keep
+// Server.WriteTimeout in mind for long lived streams.
+//
+//	res, events := falcore.SSEResponse(req.HttpRequest, nil)
+//	go func() {
+//		defer events.Close()
+//		for update := range updates {
+//			if events.Send(&falcore.SSEEvent{Data: update}) != nil {
+//				return
+//			}
+//		}
+//	}()
+//	return res
+func SSEResponse(req *http.Request, headers http.Header) (*http.Response, *SSEWriter) {
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set("Content-Type", "text/event-stream")
+	if headers.Get("Cache-Control") == "" {
+		headers.Set("Cache-Control", "no-cache")
+	}
+
+	res, sw := StreamResponse(req, 200, headers)
+	w := &SSEWriter{w: sw}
+	if req != nil {
+		w.lastEventID = req.Header.Get("Last-Event-ID")
+	}
+	return res, w
+}
+
+// The ID of the last event the client saw before reconnecting, from
+// the Last-Event-ID request header.  Empty on the first connection.
+// Resume the stream after this event.
+func (w *SSEWriter) LastEventID() string {
+	return w.lastEventID
+}
+
+// Sends an event
+func (w *SSEWriter) Send(ev *SSEEvent) error {
+	if strings.ContainsAny(ev.ID, "\r\n") || strings.ContainsAny(ev.Event, "\r\n") {
+		return errors.New("falcore: SSE event id and type can't contain newlines")
+	}
+	var buf bytes.Buffer
+	if ev.ID != "" {
+		fmt.Fprintf(&buf, "id: %s\n", ev.ID)
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", ev.Event)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&buf, "retry: %d\n", ev.Retry/time.Millisecond)
+	}
+	data := strings.Replace(ev.Data, "\r\n", "\n", -1)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteByte('\n')
+	return w.send(buf.Bytes())
+}
+
+// Sends a comment line.  Clients ignore these, which makes them useful
+// for keeping idle connections open through proxies.
+func (w *SSEWriter) Comment(text string) error {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(&buf, ": %s\n", line)
+	}
+	buf.WriteByte('\n')
+	return w.send(buf.Bytes())
+}
+
+func (w *SSEWriter) send(p []byte) error {
+	if _, err := w.w.Write(p); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Ends the stream
+func (w *SSEWriter) Close() error {
+	return w.w.Close()
+}
@@ -0,0 +1,66 @@
+package falcore
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSSEResponse(t *testing.T) {
+	next := make(chan bool)
+	srv := startTestServer(t, NewRequestFilter(func(req *Request) *http.Response {
+		res, events := SSEResponse(req.HttpRequest, nil)
+		go func() {
+			defer events.Close()
+			id := 0
+			fmt.Sscan(events.LastEventID(), &id)
+			events.Send(&SSEEvent{ID: fmt.Sprint(id + 1), Event: "greeting", Retry: 1500 * time.Millisecond, Data: "hello\nworld"})
+			// the client has to see the first event before we continue
+			<-next
+			events.Comment("keepalive")
+			events.Send(&SSEEvent{Data: "bye"})
+		}()
+		return res
+	}), nil)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%v/", srv.Port()), nil)
+	req.Header.Set("Last-Event-ID", "41")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Couldn't get: %v", err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+
+	br := bufio.NewReader(res.Body)
+	expected := "id: 42\nevent: greeting\nretry: 1500\ndata: hello\ndata: world\n\n"
+	var first []byte
+	for len(first) < len(expected) {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("Couldn't read first event: %v", err)
+		}
+		first = append(first, line...)
+	}
+	if string(first) != expected {
+		t.Errorf("Expected first event %q, got %q", expected, first)
+	}
+
+	close(next)
+	rest, _ := ioutil.ReadAll(br)
+	if string(rest) != ": keepalive\n\ndata: bye\n\n" {
+		t.Errorf("Unexpected end of stream %q", rest)
+	}
+}
+
+func TestSSEEventValidation(t *testing.T) {
+	_, events := SSEResponse(nil, nil)
+	if err := events.Send(&SSEEvent{ID: "a\nb"}); err == nil {
+		t.Errorf("Expected an error for an id with a newline")
+	}
+}
@@ -0,0 +1,102 @@
+package falcore
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Response bodies can implement Flusher to decide when the server's
+// write buffer is flushed to the client.  Before each Read of the body
+// the server calls ShouldFlush, and if it returns true, everything
+// written so far is sent.  Without it, output is only sent when the
+// buffer fills or the response ends, which holds back long-polling
+// and progressively rendered responses.
+type Flusher interface {
+	ShouldFlush() bool
+}
+
+// The writing end of a body made by NewStreamBody.  Data is handed to
+// the server as it's written; Flush marks a point where everything
+// written so far should reach the client.  Writes block until the
+// server has read the data, and fail once the client goes away.
+type StreamWriter struct {
+	pw    *io.PipeWriter
+	flush int32
+}
+
+// The reading end, used as the response body
+type streamBody struct {
+	*io.PipeReader
+	w *StreamWriter
+}
+
+// Creates a response body that streams whatever is written to the
+// returned StreamWriter.  The body implements Flusher, honoring the
+// writer's Flush calls.
+func NewStreamBody() (io.ReadCloser, *StreamWriter) {
+	pr, pw := io.Pipe()
+	w := &StreamWriter{pw: pw}
+	return &streamBody{pr, w}, w
+}
+
+// Generate a chunked response whose body is written through the
+// returned StreamWriter.  Write from a goroutine other than the
+// filter's so the response can be returned first, and Close the writer
+// to end the response.
+func StreamResponse(req *http.Request, status int, headers http.Header) (*http.Response, *StreamWriter) {
+	body, w := NewStreamBody()
+	return SimpleResponse(req, status, headers, -1, body), w
+}
+
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Sends everything written so far to the client.  Returns once the
+// server has picked up the flush point.
+func (w *StreamWriter) Flush() error {
+	atomic.StoreInt32(&w.flush, 1)
+	// An empty write makes the server's pending Read return, so it
+	// checks ShouldFlush before waiting for more data.
+	_, err := w.pw.Write(nil)
+	return err
+}
+
+// Ends the body
+func (w *StreamWriter) Close() error {
+	return w.pw.Close()
+}
+
+// Ends the body with an error, which aborts the response
+func (w *StreamWriter) CloseWithError(err error) error {
+	return w.pw.CloseWithError(err)
+}
+
+func (b *streamBody) ShouldFlush() bool {
+	return atomic.SwapInt32(&b.w.flush, 0) == 1
+}
+
+// Flushes the response written so far before a Read of a Flusher body,
+// when the body asks for it
+type flushBeforeRead struct {
+	io.ReadCloser
+	flusher Flusher
+	flush   func() error
+}
+
+func newFlushBeforeRead(body io.ReadCloser, flush func() error) io.ReadCloser {
+	if f, ok := body.(Flusher); ok {
+		return &flushBeforeRead{body, f, flush}
+	}
+	return body
+}
+
+func (b *flushBeforeRead) Read(p []byte) (int, error) {
+	if b.flusher.ShouldFlush() {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
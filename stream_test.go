@@ -0,0 +1,61 @@
+package falcore
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Streams a flushed first line, then waits for next before the second
+func streamPipeline(next chan bool) *Pipeline {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		res, w := StreamResponse(req.HttpRequest, 200, nil)
+		go func() {
+			defer w.Close()
+			fmt.Fprintf(w, "first\n")
+			w.Flush()
+			<-next
+			fmt.Fprintf(w, "second\n")
+		}()
+		return res
+	}))
+	return pipeline
+}
+
+func checkStream(t *testing.T, url string, next chan bool) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Couldn't get: %v", err)
+	}
+	defer res.Body.Close()
+	br := bufio.NewReader(res.Body)
+	// blocks forever if the flush didn't happen
+	if line, err := br.ReadString('\n'); line != "first\n" {
+		t.Fatalf("Expected first line, got %q %v", line, err)
+	}
+	close(next)
+	if rest, _ := ioutil.ReadAll(br); string(rest) != "second\n" {
+		t.Errorf("Expected second line, got %q", rest)
+	}
+}
+
+func TestStreamResponseFlush(t *testing.T) {
+	next := make(chan bool)
+	srv := startTestServer(t, nil, func(srv *Server) {
+		srv.Pipeline = streamPipeline(next)
+	})
+
+	checkStream(t, fmt.Sprintf("http://localhost:%v/", srv.Port()), next)
+}
+
+func TestStreamResponseServeHTTP(t *testing.T) {
+	next := make(chan bool)
+	hs := httptest.NewServer(NewServer(0, streamPipeline(next)))
+	defer hs.Close()
+
+	checkStream(t, hs.URL, next)
+}
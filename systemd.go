@@ -0,0 +1,61 @@
+package falcore
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First descriptor passed by systemd socket activation
+var listenFdsStart = 3
+
+// Adds listeners for the sockets passed by systemd socket activation
+// (LISTEN_FDS and LISTEN_PID).  If names are given, only sockets whose
+// FileDescriptorName (LISTEN_FDNAMES) matches one of them are used, so
+// several Servers in one process can each pick their own sockets.
+// Returns the number of listeners added.  If the process wasn't socket
+// activated, 0 is returned and ListenAndServe will bind Addr as usual.
+func (srv *Server) SystemdListen(names ...string) (int, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 0 {
+		return 0, fmt.Errorf("falcore: bad LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+	}
+	var fdNames []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		fdNames = strings.Split(s, ":")
+	}
+
+	added := 0
+	for i := 0; i < nfds; i++ {
+		fd := listenFdsStart + i
+		// Don't leak the sockets into child processes
+		syscall.CloseOnExec(fd)
+
+		name := "unknown" // systemd's default name
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		if len(names) > 0 && !stringIn(name, names) {
+			continue
+		}
+		if err := srv.FdListen(fd, "systemd:"+name); err != nil {
+			return added, fmt.Errorf("falcore: systemd socket %d (%s): %v", fd, name, err)
+		}
+		added++
+	}
+	return added, nil
+}
+
+func stringIn(s string, list []string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
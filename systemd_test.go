@@ -0,0 +1,107 @@
+package falcore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// Arrange for ls to look like sockets passed by systemd
+func fakeSystemdSockets(t *testing.T, names string, ls ...net.Listener) {
+	oldStart := listenFdsStart
+	listenFdsStart = 200
+	for i, l := range ls {
+		f, err := listenerFile(l)
+		if err != nil {
+			t.Fatalf("Couldn't get listener file: %v", err)
+		}
+		if err := syscall.Dup2(int(f.Fd()), listenFdsStart+i); err != nil {
+			t.Fatalf("Couldn't dup listener: %v", err)
+		}
+		f.Close()
+		l.Close()
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", strconv.Itoa(len(ls)))
+	os.Setenv("LISTEN_FDNAMES", names)
+	t.Cleanup(func() {
+		listenFdsStart = oldStart
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+}
+
+func TestSystemdListenNotActivated(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	if n, err := srv.SystemdListen(); n != 0 || err != nil {
+		t.Errorf("Expected no listeners, got %v %v", n, err)
+	}
+}
+
+func TestSystemdListen(t *testing.T) {
+	tcp, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := tcp.Addr().(*net.TCPAddr).Port
+	sock := filepath.Join(t.TempDir(), "falcore.sock")
+	unix, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.(*net.UnixListener).SetUnlinkOnClose(false)
+	fakeSystemdSockets(t, "web:sidecar", tcp, unix)
+
+	srv := startTestServer(t, okFilter, func(srv *Server) {
+		if n, err := srv.SystemdListen(); n != 2 || err != nil {
+			t.Fatalf("Expected 2 listeners, got %v %v", n, err)
+		}
+	})
+
+	if srv.Port() != port {
+		t.Errorf("Expected port %v, got %v", port, srv.Port())
+	}
+	clients := map[string]*http.Client{
+		"tcp": http.DefaultClient,
+		"unix": {Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", sock)
+			},
+		}},
+	}
+	for name, c := range clients {
+		res, err := c.Get(fmt.Sprintf("http://localhost:%v/", port))
+		if err != nil {
+			t.Errorf("%v: Couldn't get: %v", name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "OK" {
+			t.Errorf("%v: Unexpected body %q", name, body)
+		}
+	}
+}
+
+func TestSystemdListenNames(t *testing.T) {
+	a, _ := net.Listen("tcp", "localhost:0")
+	b, _ := net.Listen("tcp", "localhost:0")
+	bPort := b.Addr().(*net.TCPAddr).Port
+	fakeSystemdSockets(t, "public:admin", a, b)
+
+	srv := NewServer(0, NewPipeline())
+	if n, err := srv.SystemdListen("admin"); n != 1 || err != nil {
+		t.Fatalf("Expected 1 listener, got %v %v", n, err)
+	}
+	if srv.Port() != bPort {
+		t.Errorf("Picked the wrong socket: port %v, expected %v", srv.Port(), bPort)
+	}
+	syscall.Close(listenFdsStart)
+}
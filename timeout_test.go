@@ -0,0 +1,96 @@
+package falcore
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var readBodyFilter = NewRequestFilter(func(req *Request) *http.Response {
+	if _, err := ioutil.ReadAll(req.HttpRequest.Body); err != nil {
+		return StringResponse(req.HttpRequest, 500, nil, "Couldn't read body")
+	}
+	return StringResponse(req.HttpRequest, 200, nil, "OK")
+})
+
+func dialServer(t *testing.T, srv *Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	srv := startTestServer(t, readBodyFilter, func(srv *Server) {
+		srv.ReadHeaderTimeout = 100 * time.Millisecond
+	})
+	conn, br := dialServer(t, srv)
+
+	// Never finish the headers
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+	if res.StatusCode != 408 {
+		t.Errorf("Expected 408, got %v", res.StatusCode)
+	}
+	if !res.Close {
+		t.Errorf("Connection should be closed after a timeout")
+	}
+}
+
+func TestReadTimeoutBody(t *testing.T) {
+	srv := startTestServer(t, readBodyFilter, func(srv *Server) {
+		srv.ReadTimeout = 200 * time.Millisecond
+	})
+	conn, br := dialServer(t, srv)
+
+	// Promise a body that never fully arrives
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+	if res.StatusCode != 408 {
+		t.Errorf("Expected 408, got %v", res.StatusCode)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := startTestServer(t, readBodyFilter, func(srv *Server) {
+		srv.IdleTimeout = 100 * time.Millisecond
+		srv.ReadTimeout = 5 * time.Second
+	})
+	conn, br := dialServer(t, srv)
+
+	// Requests slower than the idle timeout are fine as long as they
+	// start in time
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n")
+	time.Sleep(200 * time.Millisecond)
+	fmt.Fprintf(conn, "\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("Expected 200, got %v", res.StatusCode)
+	}
+
+	// Then the connection is closed without a response
+	start := time.Now()
+	if b, err := br.ReadByte(); err == nil {
+		t.Errorf("Expected the idle connection to be closed, read %q", b)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Idle connection stayed open for %v", d)
+	}
+}
@@ -0,0 +1,215 @@
+package falcore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves certificates from a directory, chosen by the server name the
+// client asks for (SNI).  Each certificate is a PEM file named
+// NAME.crt, with its key in NAME.key next to it.  A certificate is used
+// for the DNS names it lists, including wildcards like *.example.com.
+// Clients that don't send a name, or ask for one no certificate
+// covers, get the certificate whose file name sorts first.
+//
+// Use it as the GetCertificate of Server.TLSConfig:
+//
+//	certs, err := falcore.NewCertStore("/etc/myapp/certs")
+//	...
+//	certs.ReloadOn(syscall.SIGHUP)
+//	srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+//	srv.ListenAndServeTLS("", "")
+//
+// Reloading swaps in the new certificates for new handshakes only.  If
+// any file fails to load, the current certificates are kept.
+type CertStore struct {
+	dir       string
+	mutex     sync.RWMutex
+	byName    map[string]*tls.Certificate
+	fallback  *tls.Certificate
+	modTimes  map[string]time.Time
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// Loads the certificates in dir
+func NewCertStore(dir string) (*CertStore, error) {
+	s := &CertStore{
+		dir:  dir,
+		stop: make(chan struct{}),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Loads the certificates in the directory again
+func (s *CertStore) Reload() error {
+	modTimes, err := s.scan()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range modTimes {
+		if strings.HasSuffix(name, ".crt") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("falcore: no certificates in %v", s.dir)
+	}
+	sort.Strings(names)
+
+	byName := make(map[string]*tls.Certificate)
+	var fallback *tls.Certificate
+	for _, name := range names {
+		certFile := filepath.Join(s.dir, name)
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("falcore: loading %v: %v", certFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("falcore: loading %v: %v", certFile, err)
+			}
+		}
+		if fallback == nil {
+			fallback = &cert
+		}
+		hosts := cert.Leaf.DNSNames
+		if len(hosts) == 0 && cert.Leaf.Subject.CommonName != "" {
+			hosts = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, host := range hosts {
+			host = strings.ToLower(host)
+			// the first file to claim a name keeps it
+			if _, ok := byName[host]; !ok {
+				byName[host] = &cert
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	s.byName = byName
+	s.fallback = fallback
+	s.modTimes = modTimes
+	s.mutex.Unlock()
+	return nil
+}
+
+// Modification times of the certificate and key files
+func (s *CertStore) scan() (map[string]time.Time, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	modTimes := make(map[string]time.Time)
+	for _, fi := range files {
+		if name := fi.Name(); strings.HasSuffix(name, ".crt") || strings.HasSuffix(name, ".key") {
+			modTimes[name] = fi.ModTime()
+		}
+	}
+	return modTimes, nil
+}
+
+// Reports whether files were added, removed or modified since the last
+// load
+func (s *CertStore) changed() bool {
+	modTimes, err := s.scan()
+	if err != nil {
+		return false
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(modTimes) != len(s.modTimes) {
+		return true
+	}
+	for name, t := range modTimes {
+		if old, ok := s.modTimes[name]; !ok || !old.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks the certificate for the server name in hello.  Use as
+// tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if s.fallback == nil {
+		return nil, errors.New("falcore: no certificates loaded")
+	}
+	return s.fallback, nil
+}
+
+// Reloads the certificates whenever one of sigs is received, until
+// Close is called
+func (s *CertStore) ReloadOn(sigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				s.reloadAndLog()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Checks the directory for changed files every interval and reloads
+// the certificates when it finds any, until Close is called
+func (s *CertStore) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.changed() {
+					s.reloadAndLog()
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *CertStore) reloadAndLog() {
+	if err := s.Reload(); err != nil {
+		Error("Certificate reload failed, keeping current certificates: %v", err)
+		return
+	}
+	Info("Reloaded certificates from %v", s.dir)
+}
+
+// Stops ReloadOn and Watch
+func (s *CertStore) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+}
@@ -0,0 +1,229 @@
+package falcore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testKeyPair struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// Makes a certificate for names signed by ca, or a self-signed CA
+// certificate if ca is nil
+func newTestKeyPair(t *testing.T, ca *testKeyPair, names ...string) *testKeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, parentKey := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeyPair{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (kp *testKeyPair) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(keyFile, kp.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, kp.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// Writes a self-signed certificate for localhost and returns the paths
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	return newTestKeyPair(t, nil, "localhost").write(t, t.TempDir(), "localhost")
+}
+
+// A tls.Config with writeTestCert's certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	cert, err := tls.LoadX509KeyPair(writeTestCert(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func certFor(t *testing.T, s *CertStore, serverName string) string {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("No certificate for %q: %v", serverName, err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewCertStore(dir); err == nil {
+		t.Errorf("Expected an error for an empty directory")
+	}
+
+	newTestKeyPair(t, nil, "a.example.com").write(t, dir, "a")
+	newTestKeyPair(t, nil, "*.b.example.com", "b.example.com").write(t, dir, "b")
+	s, err := NewCertStore(dir)
+	if err != nil {
+		t.Fatalf("Couldn't load certificates: %v", err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"A.Example.Com.", "a.example.com"},
+		{"b.example.com", "*.b.example.com"},
+		{"www.b.example.com", "*.b.example.com"},
+		{"x.www.b.example.com", "a.example.com"},
+		{"", "a.example.com"},
+	}
+	for _, test := range tests {
+		if cn := certFor(t, s, test.serverName); cn != test.expected {
+			t.Errorf("%q: Expected certificate %v, got %v", test.serverName, test.expected, cn)
+		}
+	}
+
+	// a broken pair keeps the old certificates
+	ioutil.WriteFile(filepath.Join(dir, "c.crt"), []byte("junk"), 0600)
+	if err := s.Reload(); err == nil {
+		t.Errorf("Expected an error reloading a bad certificate")
+	}
+	if cn := certFor(t, s, "a.example.com"); cn != "a.example.com" {
+		t.Errorf("Expected the old certificates after a failed reload, got %v", cn)
+	}
+
+	s.Watch(10 * time.Millisecond)
+	newTestKeyPair(t, nil, "c.example.com").write(t, dir, "c")
+	for deadline := time.Now().Add(5 * time.Second); certFor(t, s, "c.example.com") != "c.example.com"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("The changed certificate wasn't picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestKeyPair(t, nil, "Test CA")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := newTestKeyPair(t, ca, "localhost")
+	serverCert, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := startTestServer(t, NewRequestFilter(func(req *Request) *http.Response {
+		name := "none"
+		if cert := req.ClientCertificate(); cert != nil {
+			name = cert.Subject.CommonName
+		}
+		return StringResponse(req.HttpRequest, 200, nil, name)
+	}), func(srv *Server) {
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    pool,
+		}
+	})
+
+	client := newTestKeyPair(t, ca, "client")
+	clientCert, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		certs    []tls.Certificate
+		expected string
+	}{
+		{[]tls.Certificate{clientCert}, "client"},
+		{nil, "none"},
+	}
+	for _, test := range tests {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: test.certs,
+		}}}
+		res, err := c.Get(fmt.Sprintf("https://localhost:%v/", srv.Port()))
+		if err != nil {
+			t.Fatalf("Couldn't get: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != test.expected {
+			t.Errorf("Expected client %v, got %q", test.expected, body)
+		}
+	}
+}
+
+func TestListenAndServeTLSNeedsCertificate(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	if err := srv.ListenAndServeTLS("", ""); err == nil {
+		srv.StopAccepting()
+		t.Errorf("Expected an error without a certificate")
+	}
+}
+
+func TestStopAcceptingTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	srv := NewServer(0, NewPipeline())
+	// the PROXY wrapper hides the socket too
+	srv.ProxyProtocolNetworks, _ = ParseCIDRs("192.0.2.0/24")
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServeTLS(certFile, keyFile)
+	}()
+	<-srv.AcceptReady
+	srv.StopAccepting()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServeTLS didn't return after StopAccepting")
+	}
+}
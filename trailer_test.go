@@ -0,0 +1,63 @@
+package falcore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Declares a checksum trailer that's only known once the body is written
+func trailerPipeline() *Pipeline {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/fixed" {
+			res := StringResponse(req.HttpRequest, 200, nil, "fixed body")
+			res.Trailer = http.Header{"X-Checksum": {"fixed"}}
+			return res
+		}
+		res, w := StreamResponse(req.HttpRequest, 200, nil)
+		res.Trailer = http.Header{"X-Checksum": nil}
+		go func() {
+			fmt.Fprint(w, "streamed body")
+			res.Trailer.Set("X-Checksum", "streamed")
+			w.Close()
+		}()
+		return res
+	}))
+	return pipeline
+}
+
+func checkTrailer(t *testing.T, url, body, checksum string) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Couldn't get: %v", err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(b) != body {
+		t.Errorf("Expected body %q, got %q", body, b)
+	}
+	if v := res.Trailer.Get("X-Checksum"); v != checksum {
+		t.Errorf("Expected trailer %q, got %q", checksum, v)
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	srv := startTestServer(t, nil, func(srv *Server) {
+		srv.Pipeline = trailerPipeline()
+	})
+
+	url := fmt.Sprintf("http://localhost:%v", srv.Port())
+	checkTrailer(t, url+"/fixed", "fixed body", "fixed")
+	checkTrailer(t, url+"/streamed", "streamed body", "streamed")
+}
+
+func TestTrailersServeHTTP(t *testing.T) {
+	hs := httptest.NewServer(NewServer(0, trailerPipeline()))
+	defer hs.Close()
+
+	checkTrailer(t, hs.URL+"/fixed", "fixed body", "fixed")
+	checkTrailer(t, hs.URL+"/streamed", "streamed body", "streamed")
+}